@@ -170,3 +170,17 @@ func allPids(t *testing.T) []int {
 	require.NotEmpty(t, pids)
 	return pids
 }
+
+func TestGetProcessTreeUsage(t *testing.T) {
+	pid := os.Getpid()
+
+	u, err := ptree.GetProcessUsage(pid)
+	require.NoError(t, err)
+	assert.Positive(t, u.RSSAnon)
+	assert.Positive(t, u.Threads)
+	assert.Positive(t, u.OpenFDs)
+
+	tree, err := ptree.GetProcessTreeUsage(pid)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, tree.Threads, u.Threads)
+}
@@ -0,0 +1,164 @@
+//go:build linux
+
+package ptree
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicksPerSecond is the value of `USER_HZ`, the unit in which
+// `/proc/*/stat` reports CPU times. It is 100 on every architecture
+// that Linux supports.
+const clockTicksPerSecond = 100
+
+// Usage describes the resources used by a process or a process tree.
+type Usage struct {
+	RSSAnon uint64
+	RSSFile uint64
+	Swap    uint64
+	PSS     uint64
+	Threads int
+	OpenFDs int
+	CPUTime time.Duration
+}
+
+// Add adds the values in `other` to `u`.
+func (u *Usage) Add(other Usage) {
+	u.RSSAnon += other.RSSAnon
+	u.RSSFile += other.RSSFile
+	u.Swap += other.Swap
+	u.PSS += other.PSS
+	u.Threads += other.Threads
+	u.OpenFDs += other.OpenFDs
+	u.CPUTime += other.CPUTime
+}
+
+// GetProcessUsage returns the resource usage of the single process
+// `pid`. Only reading `/proc/<pid>/status` is mandatory; any of the
+// other values that can't be read (e.g., because of missing
+// permissions) are left zero.
+func GetProcessUsage(pid int) (Usage, error) {
+	var u Usage
+
+	if err := readStatus(pid, &u); err != nil {
+		return Usage{}, err
+	}
+
+	u.PSS, _ = readPSS(pid)
+	u.OpenFDs, _ = countFDs(pid)
+	u.CPUTime, _ = readCPUTime(pid)
+
+	return u, nil
+}
+
+// GetProcessTreeUsage returns the total resource usage of the tree of
+// processes rooted at `pid`. As with `GetProcessTreeRSSAnon()`,
+// errors encountered while walking the children are ignored.
+func GetProcessTreeUsage(pid int) (Usage, error) {
+	total, err := GetProcessUsage(pid)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	WalkChildren(pid, func(pid int) {
+		u, err := GetProcessUsage(pid)
+		if err != nil {
+			return
+		}
+		total.Add(u)
+	})
+
+	return total, nil
+}
+
+func readStatus(pid int, u *Usage) error {
+	f, err := procfs.Open(fmt.Sprintf("%d/status", pid))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		key, value, ok := strings.Cut(scan.Text(), ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "RssAnon":
+			u.RSSAnon, _ = parseKB(value)
+		case "RssFile":
+			u.RSSFile, _ = parseKB(value)
+		case "VmSwap":
+			u.Swap, _ = parseKB(value)
+		case "Threads":
+			u.Threads, _ = strconv.Atoi(strings.TrimSpace(value))
+		}
+	}
+	return scan.Err()
+}
+
+func readPSS(pid int) (uint64, error) {
+	f, err := procfs.Open(fmt.Sprintf("%d/smaps_rollup", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		key, value, ok := strings.Cut(scan.Text(), ":")
+		if ok && key == "Pss" {
+			return parseKB(value)
+		}
+	}
+	return 0, scan.Err()
+}
+
+func countFDs(pid int) (int, error) {
+	entries, err := fs.ReadDir(procfs, fmt.Sprintf("%d/fd", pid))
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+func readCPUTime(pid int) (time.Duration, error) {
+	data, err := fs.ReadFile(procfs, fmt.Sprintf("%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+
+	// The second field (the command name) is in parentheses and
+	// can contain spaces, so start parsing after the last ")".
+	// `utime` and `stime` are then the 12th and 13th fields.
+	s := string(data)
+	fields := strings.Fields(s[strings.LastIndexByte(s, ')')+1:])
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(utime+stime) * time.Second / clockTicksPerSecond, nil
+}
+
+// parseKB parses a value like "   1234 kB" and returns it in bytes.
+func parseKB(s string) (uint64, error) {
+	kb, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(s), " kB"), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return kb * 1024, nil
+}
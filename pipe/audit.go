@@ -0,0 +1,238 @@
+package pipe
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditRecordType distinguishes the records that are written to an
+// `AuditSink`.
+type AuditRecordType string
+
+const (
+	// AuditStart records that a command has been started.
+	AuditStart AuditRecordType = "start"
+
+	// AuditExit records that a command has exited.
+	AuditExit AuditRecordType = "exit"
+)
+
+// AuditRecord describes the start or exit of a command run by a
+// command stage. Fields that only make sense for `AuditExit` records
+// are left empty in `AuditStart` records.
+type AuditRecord struct {
+	Type  AuditRecordType `json:"type"`
+	Stage string          `json:"stage"`
+
+	// Path is the absolute, symlink-free path of the executable, if
+	// it could be determined, or else the path that was executed.
+	Path string   `json:"path"`
+	Args []string `json:"argv"`
+	Dir  string   `json:"dir,omitempty"`
+
+	// EnvSet are the environment variables ("KEY=value") that the
+	// command got in addition to, or instead of, those of this
+	// process. EnvUnset are the names of variables of this process
+	// that the command didn't get.
+	EnvSet   []string `json:"env_set,omitempty"`
+	EnvUnset []string `json:"env_unset,omitempty"`
+
+	PID       int       `json:"pid"`
+	StartTime time.Time `json:"start_time"`
+
+	EndTime time.Time `json:"end_time"`
+
+	// ExitCode is the command's exit code, or -1 if it was killed by
+	// a signal (in which case Signal is set).
+	ExitCode int    `json:"exit_code"`
+	Signal   string `json:"signal,omitempty"`
+
+	// Error is the error that the stage reported, if any.
+	Error string `json:"error,omitempty"`
+
+	// Rusage is the command's resource usage, if available.
+	Rusage *AuditRusage `json:"rusage,omitempty"`
+}
+
+// AuditRusage is the resource usage of a command that has exited.
+type AuditRusage struct {
+	UserTime   time.Duration `json:"user_time"`
+	SystemTime time.Duration `json:"system_time"`
+
+	// MaxRSS is the peak resident set size, in bytes (zero if it is
+	// not available on this platform).
+	MaxRSS int64 `json:"max_rss_bytes,omitempty"`
+}
+
+// AuditSink receives audit records. It must be safe for concurrent
+// use, because the stages of a pipeline run concurrently.
+type AuditSink interface {
+	// WriteAuditRecord records `r`. If it fails for an `AuditStart`
+	// record, the command is killed and the stage fails to start,
+	// so that no command runs without having been recorded.
+	WriteAuditRecord(r *AuditRecord) error
+}
+
+// WithAuditSink arranges for an `AuditStart` and an `AuditExit` record
+// to be written to `sink` for every command that the pipeline's
+// command stages run.
+func WithAuditSink(sink AuditSink) Option {
+	return func(p *Pipeline) {
+		p.env.auditSink = sink
+	}
+}
+
+// JSONLinesAuditSink is an `AuditSink` that writes each record as a
+// line of JSON.
+type JSONLinesAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+	c  io.Closer
+}
+
+// NewJSONLinesAuditSink returns a `JSONLinesAuditSink` that writes to
+// `w`.
+func NewJSONLinesAuditSink(w io.Writer) *JSONLinesAuditSink {
+	return &JSONLinesAuditSink{w: w}
+}
+
+// OpenJSONLinesAuditSink returns a `JSONLinesAuditSink` that appends
+// to the file at `path`, creating it if necessary. The file should be
+// closed via `Close()` when it is no longer needed.
+func OpenJSONLinesAuditSink(path string) (*JSONLinesAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLinesAuditSink{w: f, c: f}, nil
+}
+
+// WriteAuditRecord writes `r` as a single line of JSON. Since each
+// record is written with a single `Write()` call, records are not
+// interleaved even if several processes append to the same file.
+func (s *JSONLinesAuditSink) WriteAuditRecord(r *AuditRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(data)
+	return err
+}
+
+// Close closes the underlying file, if the sink was created by
+// `OpenJSONLinesAuditSink()`.
+func (s *JSONLinesAuditSink) Close() error {
+	if s.c == nil {
+		return nil
+	}
+	return s.c.Close()
+}
+
+// prepareAudit records the details of the command that don't change
+// when it is started, if the command is to be audited. It must be
+// called after the command's `Dir` and `Env` are set, but before
+// `setupSandbox()` changes the command that is actually started.
+func (s *commandStage) prepareAudit(env Env) {
+	if env.auditSink == nil {
+		return
+	}
+
+	path, err := resolveExecutable(s.cmd.Path, s.cmd.Dir)
+	if err != nil {
+		path = s.cmd.Path
+	}
+
+	r := &AuditRecord{
+		Stage: s.name,
+		Path:  path,
+		Args:  s.redactor.redactStrings(s.cmd.Args),
+		Dir:   s.cmd.Dir,
+	}
+	if s.cmd.Env != nil {
+		r.EnvSet, r.EnvUnset = envDiff(os.Environ(), s.cmd.Env)
+		r.EnvSet = s.redactor.redactStrings(r.EnvSet)
+	}
+
+	s.auditSink = env.auditSink
+	s.auditRecord = r
+}
+
+// auditStart writes the `AuditStart` record for the command, which
+// has just been started.
+func (s *commandStage) auditStart() error {
+	if s.auditSink == nil {
+		return nil
+	}
+
+	s.auditRecord.PID = s.cmd.Process.Pid
+	s.auditRecord.StartTime = s.startTime
+
+	r := *s.auditRecord
+	r.Type = AuditStart
+	if err := s.auditSink.WriteAuditRecord(&r); err != nil {
+		return fmt.Errorf("writing audit record: %w", err)
+	}
+	return nil
+}
+
+// auditExit writes the `AuditExit` record for the command, which has
+// been waited for, and which caused the stage to fail with `stageErr`
+// (possibly nil).
+func (s *commandStage) auditExit(stageErr error) error {
+	if s.auditSink == nil {
+		return nil
+	}
+
+	r := *s.auditRecord
+	r.Type = AuditExit
+	r.EndTime = time.Now()
+	if stageErr != nil {
+		r.Error = s.redactor.Redact(stageErr.Error())
+	}
+
+	if s.cmd.ProcessState != nil {
+		r.ExitCode, r.Signal, r.Rusage = s.exitStatus()
+	}
+
+	if err := s.auditSink.WriteAuditRecord(&r); err != nil {
+		return fmt.Errorf("writing audit record: %w", err)
+	}
+	return nil
+}
+
+// envDiff returns the entries of `env` that are not in `parent`, and
+// the names of variables that are in `parent` but not in `env`.
+func envDiff(parent, env []string) (set, unset []string) {
+	parentValues := make(map[string]string, len(parent))
+	for _, kv := range parent {
+		k, _, _ := strings.Cut(kv, "=")
+		parentValues[k] = kv
+	}
+
+	seen := make(map[string]bool, len(env))
+	for _, kv := range env {
+		k, _, _ := strings.Cut(kv, "=")
+		seen[k] = true
+		if parentValues[k] != kv {
+			set = append(set, kv)
+		}
+	}
+
+	for _, kv := range parent {
+		k, _, _ := strings.Cut(kv, "=")
+		if !seen[k] {
+			unset = append(unset, k)
+		}
+	}
+
+	return set, unset
+}
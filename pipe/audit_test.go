@@ -0,0 +1,147 @@
+package pipe_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/go-pipe/pipe"
+)
+
+func readAuditLog(t *testing.T, path string) []pipe.AuditRecord {
+	t.Helper()
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var records []pipe.AuditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r pipe.AuditRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &r))
+		records = append(records, r)
+	}
+	require.NoError(t, scanner.Err())
+	return records
+}
+
+func TestAuditLog(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'sh' unavailable")
+	}
+
+	t.Parallel()
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	logPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := pipe.OpenJSONLinesAuditSink(logPath)
+	require.NoError(t, err)
+
+	p := pipe.New(
+		pipe.WithDir(dir),
+		pipe.WithEnvVar("AUDIT_TEST_VAR", "value"),
+		pipe.WithAuditSink(sink),
+	)
+	p.Add(
+		pipe.Command("echo", "hello"),
+		pipe.Command("sh", "-c", "cat >/dev/null; exit 3"),
+	)
+	err = p.Run(ctx)
+	assert.Error(t, err)
+	require.NoError(t, sink.Close())
+
+	records := readAuditLog(t, logPath)
+	require.Len(t, records, 4)
+
+	byStage := make(map[string][]pipe.AuditRecord)
+	for _, r := range records {
+		byStage[r.Stage] = append(byStage[r.Stage], r)
+	}
+
+	for stage, rs := range byStage {
+		require.Len(t, rs, 2, stage)
+		start, exit := rs[0], rs[1]
+		assert.Equal(t, pipe.AuditStart, start.Type)
+		assert.Equal(t, pipe.AuditExit, exit.Type)
+		assert.True(t, filepath.IsAbs(start.Path))
+		assert.Equal(t, dir, start.Dir)
+		assert.Contains(t, start.EnvSet, "AUDIT_TEST_VAR=value")
+		assert.NotZero(t, start.PID)
+		assert.Equal(t, start.PID, exit.PID)
+		assert.False(t, exit.EndTime.Before(exit.StartTime))
+		assert.NotNil(t, exit.Rusage)
+	}
+
+	assert.Equal(t, []string{"echo", "hello"}, byStage["echo"][0].Args)
+	assert.Equal(t, 0, byStage["echo"][1].ExitCode)
+	assert.Empty(t, byStage["echo"][1].Error)
+
+	// A zero exit code is recorded explicitly:
+	data, err := json.Marshal(byStage["echo"][1])
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"exit_code":0`)
+
+	assert.Equal(t, []string{"sh", "-c", "cat >/dev/null; exit 3"}, byStage["sh"][0].Args)
+	assert.Equal(t, 3, byStage["sh"][1].ExitCode)
+	assert.NotEmpty(t, byStage["sh"][1].Error)
+}
+
+func TestAuditLogSignal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'sh' unavailable")
+	}
+
+	t.Parallel()
+	ctx := context.Background()
+
+	logPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := pipe.OpenJSONLinesAuditSink(logPath)
+	require.NoError(t, err)
+	defer sink.Close()
+
+	p := pipe.New(pipe.WithAuditSink(sink))
+	p.Add(pipe.Command("sh", "-c", "kill -TERM $$"))
+	assert.Error(t, p.Run(ctx))
+
+	records := readAuditLog(t, logPath)
+	require.Len(t, records, 2)
+	assert.Equal(t, -1, records[1].ExitCode)
+	assert.Equal(t, "terminated", records[1].Signal)
+}
+
+type failingAuditSink struct{}
+
+func (failingAuditSink) WriteAuditRecord(*pipe.AuditRecord) error {
+	return errors.New("disk full")
+}
+
+func TestAuditLogFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'sh' unavailable")
+	}
+
+	t.Parallel()
+	ctx := context.Background()
+
+	// If the start can't be recorded, the command must not get to
+	// do anything:
+	marker := filepath.Join(t.TempDir(), "marker")
+	p := pipe.New(pipe.WithAuditSink(failingAuditSink{}))
+	p.Add(pipe.Command("sh", "-c", "sleep 1; touch "+marker))
+	err := p.Run(ctx)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "writing audit record: disk full")
+	}
+	_, err = os.Stat(marker)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,66 @@
+package pipe
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrOOMKilled is the error that a command stage returns if it was
+// killed by the kernel's OOM killer because the cgroup that it was
+// running in reached its `memory.max`.
+var ErrOOMKilled = errors.New("killed by the kernel OOM killer")
+
+// CgroupOptions configures a cgroup v2 that command stages are run in,
+// so that the kernel enforces their resource limits. Cgroups are only
+// supported on Linux; elsewhere, starting a stage that uses them
+// fails.
+type CgroupOptions struct {
+	// Parent is the path of an existing, writable cgroup v2 directory
+	// (typically one that has been delegated to the current user or
+	// service, like `/sys/fs/cgroup/system.slice/foo.service`). A
+	// new child cgroup is created under it, and removed again when
+	// the processes in it have exited. Any controllers needed for
+	// the limits below are enabled in `Parent` if they aren't
+	// already.
+	Parent string
+
+	// MemoryMax, if nonzero, is written to `memory.max`, in bytes.
+	MemoryMax uint64
+
+	// CPUQuota, if nonzero, is the CPU time that the cgroup may use
+	// per `CPUPeriod`, and is written to `cpu.max`.
+	CPUQuota time.Duration
+
+	// CPUPeriod is the period for `CPUQuota`. If it is zero, the
+	// kernel's default of 100ms is used.
+	CPUPeriod time.Duration
+
+	// PidsMax, if nonzero, is written to `pids.max`.
+	PidsMax int64
+
+	// IOMax are lines that are written to `io.max`, one at a time,
+	// like "8:16 rbps=2097152 wiops=120".
+	IOMax []string
+}
+
+// WithStageCgroup arranges for the command stage `stage` to be run in
+// its own cgroup, created according to `opts` when the stage is
+// started. It returns `stage`. If the command is killed by the kernel
+// OOM killer, the stage's error is `ErrOOMKilled`. It panics if
+// `stage` is not a command stage.
+func WithStageCgroup(stage Stage, opts CgroupOptions) Stage {
+	s := mustCommandStage(stage, "WithStageCgroup")
+	s.cgroupOptions = &opts
+	return stage
+}
+
+// WithCgroup arranges for the pipeline to create a single cgroup
+// according to `opts` when it is started, and to run all of its
+// command stages (except those that have their own cgroup via
+// `WithStageCgroup()`) in it. This way, the limits apply to the
+// pipeline as a whole. The cgroup is removed when `Wait()` returns.
+func WithCgroup(opts CgroupOptions) Option {
+	return func(p *Pipeline) {
+		p.cgroupOptions = &opts
+	}
+}
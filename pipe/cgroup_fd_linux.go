@@ -0,0 +1,14 @@
+//go:build linux && go1.20
+
+package pipe
+
+import "syscall"
+
+// useCgroupFD arranges for the process to be started directly in `cg`
+// (using `clone3(CLONE_INTO_CGROUP)`). It returns true, since it
+// is supported by this version of Go.
+func useCgroupFD(attr *syscall.SysProcAttr, cg *cgroup) bool {
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(cg.dir.Fd())
+	return true
+}
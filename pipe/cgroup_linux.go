@@ -0,0 +1,231 @@
+//go:build linux
+
+package pipe
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// cgroup is a cgroup v2 directory that was created by this package.
+type cgroup struct {
+	path string
+
+	// dir is an open file descriptor for `path`, which can be used
+	// to start processes directly in the cgroup.
+	dir *os.File
+}
+
+// newCgroup creates a new child cgroup as described by `opts`.
+func newCgroup(opts CgroupOptions) (*cgroup, error) {
+	if opts.Parent == "" {
+		return nil, errors.New("cgroup: no parent cgroup specified")
+	}
+
+	var limits []struct{ file, value string }
+	addLimit := func(file, value string) {
+		limits = append(limits, struct{ file, value string }{file, value})
+	}
+	if opts.MemoryMax != 0 {
+		addLimit("memory.max", strconv.FormatUint(opts.MemoryMax, 10))
+	}
+	if opts.CPUQuota != 0 {
+		period := opts.CPUPeriod
+		if period == 0 {
+			period = 100 * time.Millisecond
+		}
+		addLimit("cpu.max", fmt.Sprintf("%d %d", opts.CPUQuota.Microseconds(), period.Microseconds()))
+	}
+	if opts.PidsMax != 0 {
+		addLimit("pids.max", strconv.FormatInt(opts.PidsMax, 10))
+	}
+	for _, line := range opts.IOMax {
+		addLimit("io.max", line)
+	}
+
+	var controllers []string
+	for _, l := range limits {
+		controllers = append(controllers, strings.SplitN(l.file, ".", 2)[0])
+	}
+	if err := enableControllers(opts.Parent, controllers); err != nil {
+		return nil, err
+	}
+
+	path, err := os.MkdirTemp(opts.Parent, "go-pipe-")
+	if err != nil {
+		return nil, fmt.Errorf("cgroup: creating child of %q: %w", opts.Parent, err)
+	}
+	cg := &cgroup{path: path}
+
+	for _, l := range limits {
+		if err := cg.write(l.file, l.value); err != nil {
+			_ = cg.remove()
+			return nil, err
+		}
+	}
+
+	cg.dir, err = os.Open(path)
+	if err != nil {
+		_ = cg.remove()
+		return nil, fmt.Errorf("cgroup: %w", err)
+	}
+
+	return cg, nil
+}
+
+// enableControllers makes sure that `controllers` are enabled for
+// the children of the cgroup at `parent`.
+func enableControllers(parent string, controllers []string) error {
+	if len(controllers) == 0 {
+		return nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(parent, "cgroup.subtree_control"))
+	if err != nil {
+		return fmt.Errorf("cgroup: %w", err)
+	}
+	enabled := make(map[string]bool)
+	for _, c := range strings.Fields(string(data)) {
+		enabled[c] = true
+	}
+
+	var missing []string
+	for _, c := range controllers {
+		if !enabled[c] {
+			enabled[c] = true
+			missing = append(missing, "+"+c)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	err = os.WriteFile(
+		filepath.Join(parent, "cgroup.subtree_control"),
+		[]byte(strings.Join(missing, " ")), 0o644,
+	)
+	if err != nil {
+		return fmt.Errorf(
+			"cgroup: enabling controllers %v in %q: %w", missing, parent, err,
+		)
+	}
+	return nil
+}
+
+func (cg *cgroup) write(file, value string) error {
+	if err := os.WriteFile(filepath.Join(cg.path, file), []byte(value), 0o644); err != nil {
+		return fmt.Errorf("cgroup: setting %s to %q: %w", file, value, err)
+	}
+	return nil
+}
+
+// oomKills returns the number of processes in the cgroup that have
+// been killed by the OOM killer, according to `memory.events`. If that
+// file can't be read (e.g., because the memory controller isn't
+// enabled), it returns zero.
+func (cg *cgroup) oomKills() uint64 {
+	f, err := os.Open(filepath.Join(cg.path, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		key, value, ok := strings.Cut(scan.Text(), " ")
+		if ok && key == "oom_kill" {
+			n, _ := strconv.ParseUint(value, 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// addProcess moves the process `pid` into the cgroup.
+func (cg *cgroup) addProcess(pid int) error {
+	return cg.write("cgroup.procs", strconv.Itoa(pid))
+}
+
+// remove kills any processes that are left in the cgroup and removes
+// it.
+func (cg *cgroup) remove() error {
+	if cg.dir != nil {
+		_ = cg.dir.Close()
+		cg.dir = nil
+	}
+
+	// `cgroup.kill` only exists since Linux 5.14, so ignore errors:
+	_ = os.WriteFile(filepath.Join(cg.path, "cgroup.kill"), []byte("1"), 0o644)
+
+	// Killed processes take a moment to disappear from the cgroup,
+	// during which it can't be removed:
+	var err error
+	for i := 0; i < 100; i++ {
+		err = syscall.Rmdir(cg.path)
+		if err != syscall.EBUSY {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("cgroup: removing %q: %w", cg.path, err)
+	}
+	return nil
+}
+
+// setupCgroup arranges for the command to be started in the
+// appropriate cgroup: its own one if it was configured with
+// `WithStageCgroup()`, otherwise the pipeline's one (if any).
+func (s *commandStage) setupCgroup(env Env) error {
+	cg := env.cgroup
+	if s.cgroupOptions != nil {
+		var err error
+		cg, err = newCgroup(*s.cgroupOptions)
+		if err != nil {
+			return err
+		}
+		s.ownCgroup = true
+	}
+	if cg == nil {
+		return nil
+	}
+
+	s.cgroup = cg
+	s.oomKillsAtStart = cg.oomKills()
+	if s.cmd.SysProcAttr == nil {
+		s.cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	s.startedInCgroup = useCgroupFD(s.cmd.SysProcAttr, cg)
+	return nil
+}
+
+// joinCgroup moves the started process into its cgroup, if that
+// couldn't be done atomically when it was started.
+func (s *commandStage) joinCgroup() error {
+	if s.cgroup == nil || s.startedInCgroup {
+		return nil
+	}
+	return s.cgroup.addProcess(s.cmd.Process.Pid)
+}
+
+// wasOOMKilled reports whether the OOM killer killed a process in the
+// command's cgroup while the command was running.
+func (s *commandStage) wasOOMKilled() bool {
+	return s.cgroup != nil && s.cgroup.oomKills() > s.oomKillsAtStart
+}
+
+// releaseCgroup removes the command's cgroup, if it is the only user
+// of it.
+func (s *commandStage) releaseCgroup() error {
+	if s.cgroup == nil || !s.ownCgroup {
+		return nil
+	}
+	return s.cgroup.remove()
+}
@@ -0,0 +1,142 @@
+//go:build linux
+
+package pipe_test
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/go-pipe/pipe"
+)
+
+// cgroupParent returns the path of the cgroup v2 that this process is
+// running in, skipping the test if it's not possible to create child
+// cgroups under it.
+func cgroupParent(t *testing.T) string {
+	t.Helper()
+
+	var mountPoint string
+	mountinfo, err := os.Open("/proc/self/mountinfo")
+	require.NoError(t, err)
+	defer mountinfo.Close()
+	scan := bufio.NewScanner(mountinfo)
+	for scan.Scan() {
+		// The filesystem type follows the " - " separator:
+		fields := strings.Fields(scan.Text())
+		for i, f := range fields {
+			if f == "-" && i+1 < len(fields) && fields[i+1] == "cgroup2" {
+				mountPoint = fields[4]
+			}
+		}
+	}
+	if mountPoint == "" {
+		t.Skip("no cgroup v2 filesystem is mounted")
+	}
+
+	data, err := os.ReadFile("/proc/self/cgroup")
+	require.NoError(t, err)
+	var path string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			path = strings.TrimPrefix(line, "0::")
+		}
+	}
+
+	parent := filepath.Join(mountPoint, path)
+	dir, err := os.MkdirTemp(parent, "go-pipe-test-")
+	if err != nil {
+		t.Skipf("cgroup %q is not writable: %v", parent, err)
+	}
+	require.NoError(t, os.Remove(dir))
+	return parent
+}
+
+func cgroupOf(t *testing.T, output string) string {
+	t.Helper()
+
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::")
+		}
+	}
+	require.Failf(t, "no cgroup v2 found", "output: %q", output)
+	return ""
+}
+
+func TestStageCgroup(t *testing.T) {
+	t.Parallel()
+	parent := cgroupParent(t)
+	ctx := context.Background()
+
+	p := pipe.New()
+	p.Add(pipe.WithStageCgroup(
+		pipe.Command("cat", "/proc/self/cgroup"),
+		pipe.CgroupOptions{Parent: parent},
+	))
+	out, err := p.Output(ctx)
+	require.NoError(t, err)
+
+	cg := cgroupOf(t, string(out))
+	assert.Contains(t, filepath.Base(cg), "go-pipe-")
+
+	// The cgroup should have been removed after the stage exited:
+	matches, err := filepath.Glob(filepath.Join(parent, "go-pipe-*"))
+	require.NoError(t, err)
+	assert.NotContains(t, matches, filepath.Join(parent, filepath.Base(cg)))
+}
+
+func TestPipelineCgroup(t *testing.T) {
+	t.Parallel()
+	parent := cgroupParent(t)
+	ctx := context.Background()
+
+	p := pipe.New(pipe.WithCgroup(pipe.CgroupOptions{Parent: parent}))
+	p.Add(
+		pipe.Command("sh", "-c", "cat /proc/self/cgroup; cat"),
+		pipe.Command("sh", "-c", "cat; cat /proc/self/cgroup"),
+	)
+	out, err := p.Output(ctx)
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	var cgroups []string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "0::") {
+			cgroups = append(cgroups, line)
+		}
+	}
+	require.Len(t, cgroups, 2)
+	assert.Equal(t, cgroups[0], cgroups[1])
+	assert.Contains(t, cgroups[0], "go-pipe-")
+}
+
+func TestStageCgroupOOMKilled(t *testing.T) {
+	t.Parallel()
+	parent := cgroupParent(t)
+
+	controllers, err := os.ReadFile(filepath.Join(parent, "cgroup.controllers"))
+	require.NoError(t, err)
+	if !strings.Contains(string(controllers), "memory") {
+		t.Skipf("memory controller is not available in %q", parent)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	p := pipe.New()
+	// `tail` buffers its never-ending input line in memory:
+	p.Add(pipe.WithStageCgroup(
+		pipe.Command("tail", "/dev/zero"),
+		pipe.CgroupOptions{Parent: parent, MemoryMax: 20_000_000},
+	))
+	err = p.Run(ctx)
+	assert.ErrorIs(t, err, pipe.ErrOOMKilled)
+}
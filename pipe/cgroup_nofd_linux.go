@@ -0,0 +1,12 @@
+//go:build linux && !go1.20
+
+package pipe
+
+import "syscall"
+
+// useCgroupFD returns false, because this version of Go can't start a
+// process directly in a cgroup. The process is moved there right
+// after it is started, instead.
+func useCgroupFD(*syscall.SysProcAttr, *cgroup) bool {
+	return false
+}
@@ -0,0 +1,37 @@
+//go:build !linux
+
+package pipe
+
+import "errors"
+
+var errCgroupsUnsupported = errors.New("cgroups are only supported on Linux")
+
+// cgroup is a placeholder on platforms that don't support cgroups.
+type cgroup struct{}
+
+func newCgroup(CgroupOptions) (*cgroup, error) {
+	return nil, errCgroupsUnsupported
+}
+
+func (cg *cgroup) remove() error {
+	return nil
+}
+
+func (s *commandStage) setupCgroup(env Env) error {
+	if s.cgroupOptions != nil || env.cgroup != nil {
+		return errCgroupsUnsupported
+	}
+	return nil
+}
+
+func (s *commandStage) joinCgroup() error {
+	return nil
+}
+
+func (s *commandStage) wasOOMKilled() bool {
+	return false
+}
+
+func (s *commandStage) releaseCgroup() error {
+	return nil
+}
@@ -8,13 +8,20 @@ import (
 	"io"
 	"os"
 	"os/exec"
-	"strings"
+	"strconv"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 )
 
+var (
+	errProcessInfoMissing = errors.New("cmd.Process is nil")
+)
+
+var _ SignalableStage = (*commandStage)(nil)
+
 // commandStage is a pipeline `Stage` based on running an external
 // command and piping the data through its stdin and stdout.
 type commandStage struct {
@@ -28,6 +35,55 @@ type commandStage struct {
 	// If the context expired, and we attempted to kill the command,
 	// `ctx.Err()` is stored here.
 	ctxErr atomic.Value
+
+	// cgroupOptions, if set, describe the cgroup that the command
+	// should be run in.
+	cgroupOptions *CgroupOptions
+
+	// cgroup is the cgroup that the command is running in, if any.
+	// `ownCgroup` is true if it was created for this stage alone.
+	cgroup          *cgroup
+	ownCgroup       bool
+	startedInCgroup bool
+	oomKillsAtStart uint64
+
+	// rlimits are set before the command is executed, if necessary
+	// by `rlimitHelper`.
+	rlimits      []Rlimit
+	rlimitHelper *rlimitHelper
+
+	// sched are scheduling attributes that override the pipeline's
+	// defaults.
+	sched schedAttrs
+
+	// sandbox, if set, describes the sandbox that the command should
+	// be run in. `sandboxProc` holds the state of the running
+	// sandbox, and `sandboxWaitStatus` the wait status of the command
+	// within it, once it has exited.
+	sandbox           *Sandbox
+	sandboxProc       *sandboxProc
+	sandboxWaitStatus *syscall.WaitStatus
+
+	// fsPolicy, if set, restricts the command's filesystem access.
+	fsPolicy *FilesystemPolicy
+
+	// auditSink, if set, receives audit records for the command,
+	// which are based on `auditRecord`.
+	auditSink   AuditSink
+	auditRecord *AuditRecord
+
+	// redactor, if set, masks secrets in the command's stderr and
+	// audit records.
+	redactor *Redactor
+
+	// envFilter determines which environment variables the command
+	// gets, on top of the pipeline's filter.
+	envFilter envFilter
+
+	// eventHandler, if set, receives the stage's lifecycle events.
+	// `startTime` is when the command was started.
+	eventHandler func(e *Event)
+	startTime    time.Time
 }
 
 // Command returns a pipeline `Stage` based on the specified external
@@ -55,6 +111,26 @@ func CommandStage(name string, cmd *exec.Cmd) Stage {
 	}
 }
 
+// mustCommandStage returns the command stage that `stage` is (or
+// wraps), for functions that configure command stages. It panics if
+// `stage` isn't a command stage.
+func mustCommandStage(stage Stage, funcName string) *commandStage {
+	for {
+		switch s := stage.(type) {
+		case *commandStage:
+			return s
+		case *memoryWatchStage:
+			stage = s.stage
+		case efStage:
+			stage = s.Stage
+		case envStage:
+			stage = s.Stage
+		default:
+			panic(fmt.Sprintf("pipe.%s: stage %q is not a command stage", funcName, stage.Name()))
+		}
+	}
+}
+
 func (s *commandStage) Name() string {
 	return s.name
 }
@@ -67,6 +143,16 @@ func (s *commandStage) Start(
 	}
 
 	s.setupEnv(ctx, env)
+	s.redactor = env.redactor.forEnv(s.cmd.Env)
+
+	if err := s.checkCommandPolicy(ctx, env); err != nil {
+		return nil, err
+	}
+
+	// Remember what is being run before `setupSandbox()` changes it:
+	argv, dir := s.cmd.Args, s.cmd.Dir
+
+	s.prepareAudit(env)
 
 	if stdin != nil {
 		// See the long comment in `Pipeline.Start()` for the
@@ -88,6 +174,16 @@ func (s *commandStage) Start(
 		return nil, err
 	}
 
+	// If the process doesn't get started, the pipes have to be closed
+	// by hand (which also ends the stderr-copying goroutine below):
+	pipes := []io.Closer{stdout}
+	abortSetup := func() {
+		for _, p := range pipes {
+			_ = p.Close()
+		}
+		_ = s.wg.Wait()
+	}
+
 	// If the caller hasn't arranged otherwise, read the command's
 	// standard error into our `stderr` field:
 	if s.cmd.Stderr == nil {
@@ -97,8 +193,10 @@ func (s *commandStage) Start(
 		// can be sure.
 		p, err := s.cmd.StderrPipe()
 		if err != nil {
+			abortSetup()
 			return nil, err
 		}
+		pipes = append(pipes, p)
 		s.wg.Go(func() error {
 			_, err := io.Copy(&s.stderr, p)
 			// We don't consider `ErrClosed` an error (FIXME: is this
@@ -113,10 +211,66 @@ func (s *commandStage) Start(
 	// Put the command in its own process group, if possible:
 	s.runInOwnProcessGroup()
 
-	if err := s.cmd.Start(); err != nil {
+	if err := s.setupSandbox(); err != nil {
+		abortSetup()
+		return nil, err
+	}
+
+	if err := s.setupRlimits(); err != nil {
+		s.releaseSandbox()
+		abortSetup()
+		return nil, err
+	}
+
+	if err := s.setupCgroup(env); err != nil {
+		s.releaseRlimits()
+		s.releaseSandbox()
+		abortSetup()
 		return nil, err
 	}
 
+	if err := s.startWithThreadAttrs(env.sched.overriddenBy(s.sched)); err != nil {
+		_ = s.releaseCgroup()
+		s.releaseRlimits()
+		s.releaseSandbox()
+		abortSetup()
+		return nil, s.sandboxStartError(err)
+	}
+	s.startTime = time.Now()
+
+	if err := s.auditStart(); err != nil {
+		s.abortStart(err)
+		return nil, err
+	}
+
+	if err := s.joinCgroup(); err != nil {
+		s.abortStart(err)
+		return nil, err
+	}
+
+	if err := s.applyRlimits(); err != nil {
+		s.abortStart(err)
+		return nil, err
+	}
+
+	if err := s.startSandbox(); err != nil {
+		s.abortStart(err)
+		return nil, err
+	}
+
+	s.eventHandler = env.eventHandler
+	emitEvent(s.eventHandler, &Event{
+		Command: s.name,
+		Msg:     "stage started",
+		Context: map[string]interface{}{
+			"pid":  s.cmd.Process.Pid,
+			"argv": argv,
+			"dir":  dir,
+		},
+		Kind: StageStarted,
+		Time: s.startTime,
+	})
+
 	// Arrange for the process to be killed (gently) if the context
 	// expires before the command exits normally:
 	go func() {
@@ -131,52 +285,79 @@ func (s *commandStage) Start(
 	return stdout, nil
 }
 
+// abortStart kills and cleans up after a process that has been
+// started, but whose setup couldn't be completed because of `err`.
+func (s *commandStage) abortStart(err error) {
+	_ = s.cmd.Process.Kill()
+	_ = s.cmd.Wait()
+	_ = s.auditExit(err)
+	_ = s.releaseCgroup()
+	s.releaseRlimits()
+	s.releaseSandbox()
+}
+
 // setupEnv sets or modifies the environment that will be passed to
 // the command.
 func (s *commandStage) setupEnv(ctx context.Context, env Env) {
-	if len(env.Vars) == 0 {
+	filter := env.envFilter.overriddenBy(s.envFilter)
+	if len(env.Vars) == 0 && env.TempDir == "" && env.idEnvVar == "" &&
+		env.stageIndexEnvVar == "" && filter.isZero() && env.envTrace == nil {
 		return
 	}
 
-	if s.cmd.Env == nil {
+	baseSource := "exec.Cmd.Env"
+	base := s.cmd.Env
+	if base == nil {
 		// If the caller didn't explicitly set an environment on
-		// `cmd`, then start with the current environment, and add a
-		// few environment variables that are meaningful to gitmon:
-		s.cmd.Env = os.Environ()
+		// `cmd`, then start with (the allowed part of) the current
+		// environment, and add a few environment variables that are
+		// meaningful to gitmon:
+		baseSource = "inherited"
+		base = filter.inherited(os.Environ())
 	}
 
 	var vars []EnvVar
-	for _, fn := range env.Vars {
-		vars = fn(ctx, vars)
+	var sources []string
+	if env.idEnvVar != "" && env.PipelineID != "" {
+		vars = append(vars, EnvVar{Key: env.idEnvVar, Value: env.PipelineID})
+		sources = append(sources, "WithID")
 	}
-	varMap := make(map[string]string, len(vars))
-	for _, v := range vars {
-		varMap[v.Key] = v.Value
+	if env.stageIndexEnvVar != "" {
+		vars = append(vars, EnvVar{Key: env.stageIndexEnvVar, Value: strconv.Itoa(env.StageIndex)})
+		sources = append(sources, "WithStageIndexEnvVar")
 	}
-
-	s.cmd.Env = copyEnvWithOverrides(s.cmd.Env, varMap)
-}
-
-func copyEnvWithOverrides(myEnv []string, overrides map[string]string) []string {
-	vars := make([]string, 0, len(myEnv)+len(overrides))
-
-	for _, v := range myEnv {
-		eq := strings.Index(v, "=")
-		if eq == -1 {
-			vars = append(vars, v)
+	if env.TempDir != "" {
+		// This comes before the variables from options, so that it can
+		// be overridden explicitly:
+		vars = append(vars, EnvVar{Key: "TMPDIR", Value: env.TempDir})
+		sources = append(sources, "WithTempDir")
+	}
+	for i, fn := range env.Vars {
+		n := len(vars)
+		vars = fn(ctx, vars)
+		if len(vars) < n {
+			sources = sources[:len(vars)]
 			continue
 		}
-		key := v[:eq]
-		if _, ok := overrides[key]; ok {
-			continue
+		for range vars[n:] {
+			sources = append(sources, env.varSource(i))
 		}
-		vars = append(vars, v)
 	}
 
-	for key, value := range overrides {
-		vars = append(vars, fmt.Sprintf("%s=%s", key, value))
+	var trace EnvTrace
+	s.cmd.Env, trace = buildEnv(base, baseSource, vars, sources, env.envTrace != nil)
+	s.cmd.Env = filter.removeUnset(s.cmd.Env)
+
+	if env.envTrace != nil {
+		r := env.redactor.forEnv(s.cmd.Env)
+		env.envTrace(s.name, r.redactEnvTrace(trace.withoutUnset(filter)))
 	}
+}
 
+// copyEnvWithOverrides returns `myEnv`, overridden by `overrides`, as
+// described for `buildEnv()`.
+func copyEnvWithOverrides(myEnv []string, overrides []EnvVar) []string {
+	vars, _ := buildEnv(myEnv, "", overrides, nil, false)
 	return vars
 }
 
@@ -201,17 +382,118 @@ func (s *commandStage) filterCmdError(err error) error {
 		// doesn't do anything on Windows, where the `Signaled()`
 		// method isn't implemented (it is hardcoded to return
 		// `false`).
-		ps, ok := eErr.ProcessState.Sys().(syscall.WaitStatus)
+		ps, ok := s.waitStatus(eErr)
 		if ok && ps.Signaled() &&
 			(ps.Signal() == syscall.SIGTERM || ps.Signal() == syscall.SIGKILL) {
 			return ctxErr
 		}
 	}
 
+	ps, ok := s.waitStatus(eErr)
+	if ok && ps.Signaled() {
+		// If the process was killed by the kernel's OOM killer,
+		// report that rather than the opaque SIGKILL:
+		if ps.Signal() == syscall.SIGKILL && s.wasOOMKilled() {
+			return ErrOOMKilled
+		}
+
+		// Likewise if it was killed for exceeding its rlimits:
+		if len(s.rlimits) != 0 {
+			if err := rlimitSignalError(ps.Signal()); err != nil {
+				return err
+			}
+		}
+	}
+
 	eErr.Stderr = s.stderr.Bytes()
+	if s.redactor != nil {
+		eErr.Stderr = []byte(s.redactor.Redact(string(eErr.Stderr)))
+	}
+	if s.sandboxWaitStatus != nil {
+		return &SandboxExitError{ExitError: eErr, WaitStatus: *s.sandboxWaitStatus}
+	}
 	return eErr
 }
 
+// waitStatus returns the wait status of the command, which exited
+// with `eErr`. For a sandboxed command, this is the status of the
+// command within the sandbox, rather than that of the sandbox's init
+// process.
+func (s *commandStage) waitStatus(eErr *exec.ExitError) (syscall.WaitStatus, bool) {
+	if s.sandboxWaitStatus != nil {
+		return *s.sandboxWaitStatus, true
+	}
+	ws, ok := eErr.ProcessState.Sys().(syscall.WaitStatus)
+	return ws, ok
+}
+
+// exitStatus returns the exit code of the command, which has been
+// waited for, the name of the signal that killed it (if any), and its
+// resource usage. The exit code is -1 if the command was killed by a
+// signal.
+func (s *commandStage) exitStatus() (exitCode int, signal string, rusage *AuditRusage) {
+	ps := s.cmd.ProcessState
+	if ps == nil {
+		return -1, "", nil
+	}
+
+	exitCode = ps.ExitCode()
+	ws, ok := ps.Sys().(syscall.WaitStatus)
+	if s.sandboxWaitStatus != nil {
+		ws, ok = *s.sandboxWaitStatus, true
+	}
+	if ok {
+		if ws.Signaled() {
+			exitCode = -1
+			signal = ws.Signal().String()
+		} else if ws.Exited() {
+			exitCode = ws.ExitStatus()
+		}
+	}
+	rusage = &AuditRusage{
+		UserTime:   ps.UserTime(),
+		SystemTime: ps.SystemTime(),
+		MaxRSS:     processMaxRSS(ps),
+	}
+	return exitCode, signal, rusage
+}
+
+// emitExited emits the `StageExited` event for the command, which
+// caused the stage to fail with `err` (possibly nil).
+func (s *commandStage) emitExited(err error) {
+	if s.eventHandler == nil {
+		return
+	}
+
+	e := stageExitedEvent(s.name, s.startTime, err)
+	exitCode, signal, rusage := s.exitStatus()
+	e.Context["exit_code"] = exitCode
+	if signal != "" {
+		e.Context["signal"] = signal
+	}
+	if rusage != nil {
+		e.Context["user_time"] = rusage.UserTime
+		e.Context["system_time"] = rusage.SystemTime
+		e.Context["max_rss"] = rusage.MaxRSS
+	}
+	s.eventHandler(e)
+}
+
+// emitKilled emits a `StageKilled` event for the command, which is
+// being sent `sig` because of `reason`, as step `step` of killing it.
+func (s *commandStage) emitKilled(reason error, sig os.Signal, step int) {
+	emitEvent(s.eventHandler, &Event{
+		Command: s.name,
+		Msg:     "stage killed",
+		Err:     reason,
+		Context: map[string]interface{}{
+			"signal":          sig.String(),
+			"escalation_step": step,
+		},
+		Kind: StageKilled,
+	})
+}
+
 func (s *commandStage) Wait() error {
 	defer close(s.done)
 
@@ -220,18 +502,28 @@ func (s *commandStage) Wait() error {
 	wErr := s.wg.Wait()
 
 	err := s.cmd.Wait()
+	s.finishSandbox()
 	err = s.filterCmdError(err)
+	if aErr := s.auditExit(err); aErr != nil && err == nil {
+		err = aErr
+	}
+	s.releaseSandbox()
 
 	if err == nil && wErr != nil {
 		err = wErr
 	}
 
+	if cErr := s.releaseCgroup(); cErr != nil && err == nil {
+		err = cErr
+	}
+
 	if s.stdin != nil {
 		cErr := s.stdin.Close()
 		if cErr != nil && err == nil {
-			return cErr
+			err = cErr
 		}
 	}
 
+	s.emitExited(err)
 	return err
 }
@@ -4,16 +4,14 @@ package pipe
 
 import (
 	"context"
-	"errors"
 
 	"github.com/github/go-pipe/internal/ptree"
 )
 
 // On linux, we can limit or observe memory usage in command stages.
-var _ LimitableStage = (*commandStage)(nil)
-
 var (
-	errProcessInfoMissing = errors.New("cmd.Process is nil")
+	_ LimitableStage   = (*commandStage)(nil)
+	_ ResourceReporter = (*commandStage)(nil)
 )
 
 func (s *commandStage) GetRSSAnon(_ context.Context) (uint64, error) {
@@ -23,3 +21,24 @@ func (s *commandStage) GetRSSAnon(_ context.Context) (uint64, error) {
 
 	return ptree.GetProcessTreeRSSAnon(s.cmd.Process.Pid)
 }
+
+func (s *commandStage) GetResourceUsage(_ context.Context) (ResourceUsage, error) {
+	if s.cmd.Process == nil {
+		return ResourceUsage{}, errProcessInfoMissing
+	}
+
+	u, err := ptree.GetProcessTreeUsage(s.cmd.Process.Pid)
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+
+	return ResourceUsage{
+		RSSAnon: u.RSSAnon,
+		RSSFile: u.RSSFile,
+		Swap:    u.Swap,
+		PSS:     u.PSS,
+		Threads: u.Threads,
+		OpenFDs: u.OpenFDs,
+		CPUTime: u.CPUTime,
+	}, nil
+}
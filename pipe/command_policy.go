@@ -0,0 +1,120 @@
+package pipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// ErrCommandNotAllowed is the error returned by the policy created by
+// `AllowCommands()` for a command that is not in its allowlist.
+var ErrCommandNotAllowed = errors.New("command not allowed")
+
+// CommandPolicy decides whether a command stage may run `cmd`. It is
+// called by the stage's `Start()` method, after `cmd` has been fully
+// configured (its `Dir`, `Env`, etc.), immediately before the command
+// would be started. If it returns an error, the command is not
+// started, an event with the command's full argv is emitted, and the
+// stage fails to start with an error wrapping the policy's error.
+type CommandPolicy func(ctx context.Context, cmd *exec.Cmd) error
+
+// WithCommandPolicy sets a policy that every command stage in the
+// pipeline must pass before its command is started. If it is used
+// more than once, all of the policies must pass.
+//
+// The policy only applies to the stages created by `Command()` or
+// `CommandStage()` (possibly wrapped, e.g., by `MemoryLimit()`) that
+// the pipeline starts. It is not a sandbox: it doesn't see commands
+// that are run by function stages or by custom `Stage`
+// implementations, nor any processes that an allowed command starts
+// itself.
+func WithCommandPolicy(policy CommandPolicy) Option {
+	return func(p *Pipeline) {
+		prev := p.env.commandPolicy
+		if prev == nil {
+			p.env.commandPolicy = policy
+			return
+		}
+		p.env.commandPolicy = func(ctx context.Context, cmd *exec.Cmd) error {
+			if err := prev(ctx, cmd); err != nil {
+				return err
+			}
+			return policy(ctx, cmd)
+		}
+	}
+}
+
+// AllowCommands returns a `CommandPolicy` that only allows commands
+// whose executable is one of `paths`. The comparison is based on
+// resolved paths: the command's path (as found via `$PATH` when the
+// command was created, interpreted relative to its `Dir` if it is
+// relative) and each of `paths` are made absolute and have their
+// symlinks resolved. `paths` are resolved when this function is
+// called. Commands that are rejected get an error wrapping
+// `ErrCommandNotAllowed`.
+func AllowCommands(paths ...string) CommandPolicy {
+	allowed := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		if resolved, err := resolveExecutable(path, ""); err == nil {
+			allowed[resolved] = true
+		}
+	}
+
+	return func(_ context.Context, cmd *exec.Cmd) error {
+		resolved, err := resolveExecutable(cmd.Path, cmd.Dir)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrCommandNotAllowed, cmd.Path, err)
+		}
+		if !allowed[resolved] {
+			return fmt.Errorf("%w: %s", ErrCommandNotAllowed, resolved)
+		}
+		return nil
+	}
+}
+
+// resolveExecutable returns the absolute, symlink-free version of
+// `path`, interpreted relative to `dir` (or the current directory, if
+// `dir` is empty).
+func resolveExecutable(path, dir string) (string, error) {
+	if !filepath.IsAbs(path) {
+		if dir == "" {
+			wd, err := os.Getwd()
+			if err != nil {
+				return "", err
+			}
+			dir = wd
+		}
+		path = filepath.Join(dir, path)
+	}
+	return filepath.EvalSymlinks(path)
+}
+
+// checkCommandPolicy applies `env`'s command policy (if any) to the
+// command, reporting a rejection via `env`'s event handler.
+func (s *commandStage) checkCommandPolicy(ctx context.Context, env Env) error {
+	if env.commandPolicy == nil {
+		return nil
+	}
+
+	err := env.commandPolicy(ctx, s.cmd)
+	if err == nil {
+		return nil
+	}
+
+	if env.eventHandler != nil {
+		env.eventHandler(&Event{
+			Command: s.name,
+			Msg:     "command rejected by policy",
+			Err:     err,
+			Context: map[string]interface{}{
+				"path": s.cmd.Path,
+				"argv": s.cmd.Args,
+				"dir":  s.cmd.Dir,
+			},
+		})
+	}
+	return fmt.Errorf("command rejected by policy: %w", err)
+}
@@ -0,0 +1,98 @@
+package pipe_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/go-pipe/pipe"
+)
+
+func TestAllowCommands(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'true' unavailable")
+	}
+
+	t.Parallel()
+	ctx := context.Background()
+
+	truePath, err := exec.LookPath("true")
+	require.NoError(t, err)
+
+	// Allow `true` only via a symlink, to check that paths are
+	// resolved:
+	link := filepath.Join(t.TempDir(), "true")
+	require.NoError(t, os.Symlink(truePath, link))
+
+	var events []*pipe.Event
+	newPipeline := func() *pipe.Pipeline {
+		return pipe.New(
+			pipe.WithCommandPolicy(pipe.AllowCommands(link)),
+			pipe.WithEventHandler(func(e *pipe.Event) { events = append(events, e) }),
+		)
+	}
+
+	p := newPipeline()
+	p.Add(pipe.Command("true"))
+	assert.NoError(t, p.Run(ctx))
+	assert.Empty(t, events)
+
+	p = newPipeline()
+	p.Add(
+		pipe.Command("true"),
+		pipe.Command("false", "--some", "arg"),
+	)
+	err = p.Run(ctx)
+	assert.ErrorIs(t, err, pipe.ErrCommandNotAllowed)
+
+	require.NotEmpty(t, events)
+	e := events[0]
+	assert.Equal(t, "false", e.Command)
+	assert.Equal(t, "command rejected by policy", e.Msg)
+	assert.ErrorIs(t, e.Err, pipe.ErrCommandNotAllowed)
+	assert.Equal(t, []string{"false", "--some", "arg"}, e.Context["argv"])
+}
+
+func TestCommandPolicy(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'echo' unavailable")
+	}
+
+	t.Parallel()
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	errNoSecrets := errors.New("no secrets")
+
+	var seen [][]string
+	p := pipe.New(
+		pipe.WithDir(dir),
+		pipe.WithCommandPolicy(func(_ context.Context, cmd *exec.Cmd) error {
+			assert.Equal(t, dir, cmd.Dir)
+			seen = append(seen, cmd.Args)
+			return nil
+		}),
+		pipe.WithCommandPolicy(func(_ context.Context, cmd *exec.Cmd) error {
+			for _, arg := range cmd.Args {
+				if arg == "secret" {
+					return errNoSecrets
+				}
+			}
+			return nil
+		}),
+	)
+	p.Add(
+		pipe.Command("echo", "hello"),
+		pipe.Command("cat", "secret"),
+	)
+	err := p.Run(ctx)
+	assert.ErrorIs(t, err, errNoSecrets)
+	assert.Equal(t, [][]string{{"echo", "hello"}, {"cat", "secret"}}, seen)
+}
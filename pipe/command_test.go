@@ -10,12 +10,12 @@ func TestCopyEnvWithOverride(t *testing.T) {
 	examples := []struct {
 		label          string
 		env            []string
-		overrides      map[string]string
+		overrides      []EnvVar
 		expectedResult []string
 	}{
 		{
-			label:     "empty",
-			overrides: map[string]string{}, // can't be nil
+			label:          "empty",
+			expectedResult: []string{},
 		},
 		{
 			label: "original env only",
@@ -23,7 +23,6 @@ func TestCopyEnvWithOverride(t *testing.T) {
 				"A=B",
 				"B=C",
 			},
-			overrides: map[string]string{},
 			expectedResult: []string{
 				"A=B",
 				"B=C",
@@ -32,13 +31,13 @@ func TestCopyEnvWithOverride(t *testing.T) {
 		{
 			label: "overrides only",
 			env:   []string{},
-			overrides: map[string]string{
-				"A": "B",
-				"B": "C",
+			overrides: []EnvVar{
+				{Key: "B", Value: "C"},
+				{Key: "A", Value: "B"},
 			},
 			expectedResult: []string{
-				"A=B",
 				"B=C",
+				"A=B",
 			},
 		},
 		{
@@ -47,13 +46,13 @@ func TestCopyEnvWithOverride(t *testing.T) {
 				"ORIGINAL1=abc",
 				"ORIGINAL2=def",
 			},
-			overrides: map[string]string{
-				"ORIGINAL1": "override1",
-				"OVERRIDE1": "also override",
+			overrides: []EnvVar{
+				{Key: "ORIGINAL1", Value: "override1"},
+				{Key: "OVERRIDE1", Value: "also override"},
 			},
 			expectedResult: []string{
-				"ORIGINAL1=override1",
 				"ORIGINAL2=def",
+				"ORIGINAL1=override1",
 				"OVERRIDE1=also override",
 			},
 		},
@@ -63,22 +62,41 @@ func TestCopyEnvWithOverride(t *testing.T) {
 				"ORIGINAL1=abc=foo",
 				"ORIGINAL2=def=bar",
 			},
-			overrides: map[string]string{
-				"ORIGINAL1": "new=new-new",
-				"OVERRIDE1": "also=new-new",
+			overrides: []EnvVar{
+				{Key: "ORIGINAL1", Value: "new=new-new"},
+				{Key: "OVERRIDE1", Value: "also=new-new"},
 			},
 			expectedResult: []string{
-				"ORIGINAL1=new=new-new",
 				"ORIGINAL2=def=bar",
+				"ORIGINAL1=new=new-new",
 				"OVERRIDE1=also=new-new",
 			},
 		},
+		{
+			label: "repeated overrides",
+			env: []string{
+				"ORIGINAL1=abc",
+				"ORIGINAL2=def",
+			},
+			overrides: []EnvVar{
+				{Key: "OVERRIDE1", Value: "first"},
+				{Key: "ORIGINAL1", Value: "override1"},
+				{Key: "OVERRIDE2", Value: "second"},
+				{Key: "OVERRIDE1", Value: "third"},
+			},
+			expectedResult: []string{
+				"ORIGINAL2=def",
+				"OVERRIDE1=third",
+				"ORIGINAL1=override1",
+				"OVERRIDE2=second",
+			},
+		},
 	}
 
 	for _, ex := range examples {
 		ex := ex
 		t.Run(ex.label, func(t *testing.T) {
-			assert.ElementsMatch(t, ex.expectedResult,
+			assert.Equal(t, ex.expectedResult,
 				copyEnvWithOverrides(ex.env, ex.overrides))
 		})
 	}
@@ -4,10 +4,20 @@
 package pipe
 
 import (
+	"fmt"
+	"os"
+	"runtime"
 	"syscall"
 	"time"
 )
 
+// stopSignal and continueSignal are used to pause and resume command
+// stages.
+var (
+	stopSignal     os.Signal = syscall.SIGSTOP
+	continueSignal os.Signal = syscall.SIGCONT
+)
+
 // runInOwnProcessGroup arranges for `cmd` to be run in its own
 // process group.
 func (s *commandStage) runInOwnProcessGroup() {
@@ -18,6 +28,56 @@ func (s *commandStage) runInOwnProcessGroup() {
 	s.cmd.SysProcAttr.Setpgid = true
 }
 
+// rlimitSignalError returns the error corresponding to `sig` if it is
+// one of the signals that the kernel sends when a process exceeds its
+// rlimits, or nil otherwise.
+func rlimitSignalError(sig syscall.Signal) error {
+	switch sig {
+	case syscall.SIGXCPU:
+		return ErrCPULimitExceeded
+	case syscall.SIGXFSZ:
+		return ErrFileSizeLimitExceeded
+	default:
+		return nil
+	}
+}
+
+// processMaxRSS returns the peak resident set size of the process
+// that `ps` describes, in bytes.
+func processMaxRSS(ps *os.ProcessState) int64 {
+	ru, ok := ps.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+	// `ru_maxrss` is in bytes on macOS, but in kilobytes elsewhere:
+	if runtime.GOOS == "darwin" {
+		return int64(ru.Maxrss)
+	}
+	return int64(ru.Maxrss) * 1024
+}
+
+// Signal sends `sig` to the command's process group.
+func (s *commandStage) Signal(sig os.Signal) error {
+	if s.cmd.Process == nil {
+		return errProcessInfoMissing
+	}
+
+	select {
+	case <-s.done:
+		return os.ErrProcessDone
+	default:
+	}
+
+	ssig, ok := sig.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("unsupported signal %v", sig)
+	}
+
+	// We started the process with PGID == PID. The same race as in
+	// `Kill()` applies here.
+	return syscall.Kill(-s.cmd.Process.Pid, ssig)
+}
+
 // kill is called to kill the process if the context expires. `err` is
 // the corresponding value of `Context.Err()`.
 func (s *commandStage) Kill(err error) {
@@ -50,8 +110,13 @@ func (s *commandStage) Kill(err error) {
 
 	// First try to kill using a relatively gentle signal so that
 	// the processes have a chance to clean up after themselves:
+	s.emitKilled(err, syscall.SIGTERM, 1)
 	_ = syscall.Kill(-pid, syscall.SIGTERM)
 
+	// In case the pipeline is paused, continue the processes so
+	// that they can act on the SIGTERM:
+	_ = syscall.Kill(-pid, syscall.SIGCONT)
+
 	// Well-behaved processes should commit suicide after the above,
 	// but if they don't exit within 2s, murder the whole lot of them:
 	go func() {
@@ -65,6 +130,7 @@ func (s *commandStage) Kill(err error) {
 		case <-s.done:
 			// Process has ended; no need to kill it again.
 		case <-timer.C:
+			s.emitKilled(err, syscall.SIGKILL, 2)
 			_ = syscall.Kill(-pid, syscall.SIGKILL)
 		}
 	}()
@@ -0,0 +1,187 @@
+//go:build !windows
+// +build !windows
+
+package pipe_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/go-pipe/pipe"
+)
+
+func TestCommandSignal(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	stage := pipe.Command(
+		"sh", "-c", `trap 'echo got USR1; exit 0' USR1; echo ready; while :; do sleep 0.1; done`,
+	)
+	stdout, err := stage.Start(ctx, pipe.Env{}, nil)
+	require.NoError(t, err)
+
+	r := bufio.NewReader(stdout)
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ready\n", line)
+
+	ss, ok := stage.(pipe.SignalableStage)
+	require.True(t, ok)
+	require.NoError(t, ss.Signal(syscall.SIGUSR1))
+
+	line, err = r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "got USR1\n", line)
+	assert.NoError(t, stage.Wait())
+
+	assert.ErrorIs(t, ss.Signal(syscall.SIGUSR1), os.ErrProcessDone)
+}
+
+func TestPipelineSignal(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	r, w := io.Pipe()
+	p := pipe.New(pipe.WithStdoutCloser(w))
+	p.Add(
+		pipe.Command("sh", "-c", `trap 'echo got USR1; exit 0' USR1; echo ready; while :; do sleep 0.1; done`),
+		// A function stage is not signaled:
+		pipe.Function(
+			"copy",
+			func(_ context.Context, _ pipe.Env, stdin io.Reader, stdout io.Writer) error {
+				_, err := io.Copy(stdout, stdin)
+				return err
+			},
+		),
+	)
+	require.NoError(t, p.Start(ctx))
+
+	br := bufio.NewReader(r)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ready\n", line)
+
+	require.NoError(t, p.Signal(syscall.SIGUSR1))
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "got USR1\n", string(rest))
+	assert.NoError(t, p.Wait())
+}
+
+func TestPipelineAbort(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	quotaExceeded := errors.New("quota exceeded")
+
+	p := pipe.New()
+	p.Add(
+		pipe.Command("sleep", "10"),
+		pipe.Function(
+			"wait-for-ctx",
+			func(ctx context.Context, _ pipe.Env, _ io.Reader, _ io.Writer) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+		),
+	)
+	require.NoError(t, p.Start(ctx))
+
+	p.Abort(quotaExceeded)
+	// Only the first cause counts:
+	p.Abort(errors.New("shutting down"))
+
+	err := p.Wait()
+	assert.ErrorIs(t, err, quotaExceeded)
+	assert.NotErrorIs(t, err, context.Canceled)
+
+	var stageErr *pipe.StageError
+	if assert.ErrorAs(t, err, &stageErr) {
+		assert.Equal(t, "sleep", stageErr.Stage)
+	}
+}
+
+func TestPipelineAbortKeepsOtherErrors(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	oops := errors.New("oops")
+
+	p := pipe.New()
+	p.Add(
+		pipe.Function(
+			"fail-after-ctx",
+			func(ctx context.Context, _ pipe.Env, _ io.Reader, _ io.Writer) error {
+				<-ctx.Done()
+				return oops
+			},
+		),
+	)
+	require.NoError(t, p.Start(ctx))
+
+	p.Abort(errors.New("shutting down"))
+	assert.ErrorIs(t, p.Wait(), oops)
+}
+
+func TestPipelineSignalForwarding(t *testing.T) {
+	// Not parallel, because this sends a signal to the whole test
+	// process.
+	ctx := context.Background()
+
+	r, w := io.Pipe()
+	p := pipe.New(pipe.WithStdoutCloser(w), pipe.WithSignalForwarding(syscall.SIGUSR2))
+	p.Add(
+		pipe.Command("sh", "-c", `trap 'echo got USR2; exit 0' USR2; echo ready; while :; do sleep 0.1; done`),
+	)
+	require.NoError(t, p.Start(ctx))
+
+	br := bufio.NewReader(r)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ready\n", line)
+
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGUSR2))
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "got USR2\n", string(rest))
+	assert.NoError(t, p.Wait())
+}
+
+func TestPipelineSignalForwardingWithoutSignals(t *testing.T) {
+	// Not parallel, because this sends a signal to the whole test
+	// process.
+	ctx := context.Background()
+
+	// Without any signals, nothing is forwarded (as opposed to every
+	// signal that this process receives):
+	r, w := io.Pipe()
+	p := pipe.New(pipe.WithStdoutCloser(w), pipe.WithSignalForwarding())
+	p.Add(
+		pipe.Command(
+			"sh", "-c",
+			`trap 'echo got WINCH; exit 0' WINCH; echo ready; for i in 1 2 3 4 5; do sleep 0.1; done`,
+		),
+	)
+	require.NoError(t, p.Start(ctx))
+
+	br := bufio.NewReader(r)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ready\n", line)
+
+	// `SIGWINCH` is ignored by default, so this doesn't affect the test
+	// process.
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGWINCH))
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Empty(t, string(rest))
+	assert.NoError(t, p.Wait())
+}
@@ -3,9 +3,49 @@
 
 package pipe
 
+import (
+	"os"
+	"syscall"
+)
+
+// stopSignal and continueSignal are nil because pausing command stages
+// is not supported on Windows.
+var (
+	stopSignal     os.Signal
+	continueSignal os.Signal
+)
+
 // runInOwnProcessGroup is not supported on Windows.
 func (s *commandStage) runInOwnProcessGroup() {}
 
+// rlimitSignalError always returns nil, because Windows doesn't
+// support rlimits.
+func rlimitSignalError(syscall.Signal) error {
+	return nil
+}
+
+// processMaxRSS returns 0, because the peak resident set size is not
+// available on Windows.
+func processMaxRSS(*os.ProcessState) int64 {
+	return 0
+}
+
+// Signal sends `sig` to the command. (Windows only supports
+// `os.Kill`.)
+func (s *commandStage) Signal(sig os.Signal) error {
+	if s.cmd.Process == nil {
+		return errProcessInfoMissing
+	}
+
+	select {
+	case <-s.done:
+		return os.ErrProcessDone
+	default:
+	}
+
+	return s.cmd.Process.Signal(sig)
+}
+
 // kill is called to kill the process if the context expires. `err` is
 // the corresponding value of `Context.Err()`.
 func (s *commandStage) Kill(err error) {
@@ -25,5 +65,6 @@ func (s *commandStage) Kill(err error) {
 	// for this stage.
 	s.ctxErr.Store(err)
 
+	s.emitKilled(err, os.Kill, 1)
 	s.cmd.Process.Kill()
 }
@@ -0,0 +1,158 @@
+package pipe
+
+import (
+	"path"
+	"strings"
+)
+
+// envFilter describes which environment variables command stages
+// inherit from this process, and which they get at all.
+type envFilter struct {
+	// clean, if set, means that no variables are inherited, except
+	// those matching `allow`.
+	clean bool
+
+	// allow, if non-nil, are glob patterns (as for `path.Match()`)
+	// for the names of the variables that may be inherited.
+	allow []string
+
+	// unset are the names of variables that are removed from the
+	// command's environment, whether inherited or set explicitly.
+	unset []string
+}
+
+// WithCleanEnv arranges for command stages not to inherit any
+// environment variables from this process. They only get the
+// variables set explicitly (e.g., via `WithEnvVar()`) and those
+// allowed by `WithEnvAllowlist()`. This, like `WithEnvAllowlist()`,
+// only applies to commands whose `exec.Cmd.Env` is nil (i.e., that
+// would otherwise inherit the whole environment); an explicit
+// `exec.Cmd.Env` is used as it is, except that the variables named by
+// `WithUnsetEnv()` are still removed from it.
+func WithCleanEnv() Option {
+	return func(p *Pipeline) {
+		p.env.envFilter.clean = true
+	}
+}
+
+// WithEnvAllowlist arranges for command stages to only inherit those
+// of this process's environment variables whose names match one of
+// `patterns`, which are glob patterns like "LC_*" (see
+// `path.Match()`). Variables set explicitly (e.g., via `WithEnvVar()`)
+// are not affected. It can be used more than once, in which case all
+// of the patterns apply.
+func WithEnvAllowlist(patterns ...string) Option {
+	return func(p *Pipeline) {
+		p.env.envFilter.allow = append(p.env.envFilter.allow, patterns...)
+		if p.env.envFilter.allow == nil {
+			p.env.envFilter.allow = []string{}
+		}
+	}
+}
+
+// WithUnsetEnv arranges for the variables named `keys` to be removed
+// from the environment of command stages, even if they are set
+// explicitly for the pipeline (e.g., via `WithEnvVar()`) or in the
+// command's `exec.Cmd.Env`.
+func WithUnsetEnv(keys ...string) Option {
+	return func(p *Pipeline) {
+		p.env.envFilter.unset = append(p.env.envFilter.unset, keys...)
+	}
+}
+
+// WithStageCleanEnv is like `WithCleanEnv()`, but only for the command
+// stage `stage`. It returns `stage`, and panics if `stage` is not a
+// command stage.
+func WithStageCleanEnv(stage Stage) Stage {
+	s := mustCommandStage(stage, "WithStageCleanEnv")
+	s.envFilter.clean = true
+	return stage
+}
+
+// WithStageEnvAllowlist is like `WithEnvAllowlist()`, but only for the
+// command stage `stage`, and it replaces the pipeline's allowlist
+// rather than adding to it. It returns `stage`, and panics if `stage`
+// is not a command stage.
+func WithStageEnvAllowlist(stage Stage, patterns ...string) Stage {
+	s := mustCommandStage(stage, "WithStageEnvAllowlist")
+	s.envFilter.allow = append(s.envFilter.allow, patterns...)
+	if s.envFilter.allow == nil {
+		s.envFilter.allow = []string{}
+	}
+	return stage
+}
+
+// WithStageUnsetEnv is like `WithUnsetEnv()`, but only for the
+// command stage `stage`, in addition to the variables unset for the
+// whole pipeline. It returns `stage`, and panics if `stage` is not a
+// command stage.
+func WithStageUnsetEnv(stage Stage, keys ...string) Stage {
+	s := mustCommandStage(stage, "WithStageUnsetEnv")
+	s.envFilter.unset = append(s.envFilter.unset, keys...)
+	return stage
+}
+
+func (f envFilter) isZero() bool {
+	return !f.clean && f.allow == nil && len(f.unset) == 0
+}
+
+// overriddenBy returns the filter that results from applying the
+// stage-specific filter `o` on top of `f`.
+func (f envFilter) overriddenBy(o envFilter) envFilter {
+	result := envFilter{
+		clean: f.clean || o.clean,
+		allow: f.allow,
+	}
+	if o.allow != nil {
+		result.allow = o.allow
+	}
+	result.unset = append(append(result.unset, f.unset...), o.unset...)
+	return result
+}
+
+// inherited returns the subset of `environ`, which is this process's
+// environment, that command stages should inherit. The result is
+// never nil, because a nil `exec.Cmd.Env` would mean to inherit
+// everything.
+func (f envFilter) inherited(environ []string) []string {
+	if !f.clean && f.allow == nil {
+		return environ
+	}
+
+	vars := make([]string, 0, len(environ))
+	for _, kv := range environ {
+		key, _, _ := strings.Cut(kv, "=")
+		for _, pattern := range f.allow {
+			if ok, _ := path.Match(pattern, key); ok {
+				vars = append(vars, kv)
+				break
+			}
+		}
+	}
+	return vars
+}
+
+// removeUnset returns `env` without the variables that `f` unsets.
+func (f envFilter) removeUnset(env []string) []string {
+	if len(f.unset) == 0 {
+		return env
+	}
+
+	vars := make([]string, 0, len(env))
+	for _, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		if !f.unsets(key) {
+			vars = append(vars, kv)
+		}
+	}
+	return vars
+}
+
+func (f envFilter) unsets(key string) bool {
+	for _, k := range f.unset {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
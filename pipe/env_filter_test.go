@@ -0,0 +1,112 @@
+package pipe_test
+
+import (
+	"context"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/go-pipe/pipe"
+)
+
+// envOf runs `env` as the first stage, wrapped by `wrap`, in a
+// pipeline with `options`, and returns the variables that it sees
+// whose names start with "PIPE_ENV_TEST_".
+func envOf(t *testing.T, wrap func(pipe.Stage) pipe.Stage, options ...pipe.Option) []string {
+	t.Helper()
+
+	p := pipe.New(options...)
+	p.Add(wrap(pipe.Command("env")))
+	out, err := p.Output(context.Background())
+	require.NoError(t, err)
+
+	var vars []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "PIPE_ENV_TEST_") {
+			vars = append(vars, line)
+		}
+	}
+	sort.Strings(vars)
+	return vars
+}
+
+func TestEnvFilters(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'env' unavailable")
+	}
+
+	t.Setenv("PIPE_ENV_TEST_A", "a")
+	t.Setenv("PIPE_ENV_TEST_B", "b")
+	t.Setenv("PIPE_ENV_TEST_SECRET", "s")
+
+	noWrap := func(s pipe.Stage) pipe.Stage { return s }
+
+	assert.Equal(t,
+		[]string{"PIPE_ENV_TEST_A=a", "PIPE_ENV_TEST_B=b", "PIPE_ENV_TEST_SECRET=s"},
+		envOf(t, noWrap),
+	)
+
+	assert.Equal(t,
+		[]string{"PIPE_ENV_TEST_X=x"},
+		envOf(t, noWrap, pipe.WithCleanEnv(), pipe.WithEnvVar("PIPE_ENV_TEST_X", "x")),
+	)
+
+	assert.Equal(t,
+		[]string{"PIPE_ENV_TEST_A=a", "PIPE_ENV_TEST_B=b"},
+		envOf(t, noWrap, pipe.WithEnvAllowlist("PIPE_ENV_TEST_?")),
+	)
+
+	assert.Equal(t,
+		[]string{"PIPE_ENV_TEST_A=a", "PIPE_ENV_TEST_B=b"},
+		envOf(t, noWrap, pipe.WithCleanEnv(), pipe.WithEnvAllowlist("PIPE_ENV_TEST_A", "PIPE_ENV_TEST_B")),
+	)
+
+	// Unsetting also applies to variables set for the pipeline:
+	assert.Equal(t,
+		[]string{"PIPE_ENV_TEST_B=b"},
+		envOf(t, noWrap,
+			pipe.WithUnsetEnv("PIPE_ENV_TEST_A", "PIPE_ENV_TEST_SECRET", "PIPE_ENV_TEST_X"),
+			pipe.WithEnvVar("PIPE_ENV_TEST_X", "x"),
+		),
+	)
+}
+
+func TestStageEnvFilters(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'env' unavailable")
+	}
+
+	t.Setenv("PIPE_ENV_TEST_A", "a")
+	t.Setenv("PIPE_ENV_TEST_B", "b")
+
+	assert.Equal(t,
+		[]string{"PIPE_ENV_TEST_X=x"},
+		envOf(t,
+			func(s pipe.Stage) pipe.Stage { return pipe.WithStageCleanEnv(s) },
+			pipe.WithEnvVar("PIPE_ENV_TEST_X", "x"),
+		),
+	)
+
+	// The stage's allowlist replaces the pipeline's:
+	assert.Equal(t,
+		[]string{"PIPE_ENV_TEST_B=b"},
+		envOf(t,
+			func(s pipe.Stage) pipe.Stage { return pipe.WithStageEnvAllowlist(s, "PIPE_ENV_TEST_B") },
+			pipe.WithEnvAllowlist("PIPE_ENV_TEST_A"),
+		),
+	)
+
+	// The stage's unset variables add to the pipeline's:
+	assert.Empty(t,
+		envOf(t,
+			func(s pipe.Stage) pipe.Stage { return pipe.WithStageUnsetEnv(s, "PIPE_ENV_TEST_B") },
+			pipe.WithUnsetEnv("PIPE_ENV_TEST_A"),
+		),
+	)
+
+	assert.Panics(t, func() { pipe.WithStageCleanEnv(pipe.Println("foo")) })
+}
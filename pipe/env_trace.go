@@ -0,0 +1,138 @@
+package pipe
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EnvTraceEntry describes where one variable in a command's
+// environment came from.
+type EnvTraceEntry struct {
+	Key   string
+	Value string
+
+	// Source describes where the value came from: "inherited" (from
+	// this process's environment), "exec.Cmd.Env" (set explicitly on
+	// the command), or the option that set it, like
+	// `WithEnvVar("GIT_DIR")`.
+	Source string
+
+	// Overridden are the sources of earlier values of the variable
+	// that this value replaced, in order.
+	Overridden []string
+}
+
+// EnvTrace describes a command's environment, in the order in which
+// the variables are passed to the command.
+type EnvTrace []EnvTraceEntry
+
+// WithEnvTrace arranges for `handler` to be called with the name of
+// each command stage and the trace of its environment, when the stage
+// is started. This helps to find out which option set (or overrode) a
+// variable. If the pipeline has a redactor (see `WithRedactor()`), the
+// values in the trace are redacted.
+func WithEnvTrace(handler func(stage string, trace EnvTrace)) Option {
+	return func(p *Pipeline) {
+		p.env.envTrace = handler
+	}
+}
+
+// addVars appends `fn` to the variables in `env`, recording `source`
+// as the origin of the variables that it adds.
+func (env *Env) addVars(source string, fn AppendVars) {
+	// `Env.Vars` is exported, so it might have been extended without
+	// recording the sources:
+	for len(env.varSources) < len(env.Vars) {
+		env.varSources = append(env.varSources, fmt.Sprintf("Env.Vars[%d]", len(env.varSources)))
+	}
+	env.Vars = append(env.Vars, fn)
+	env.varSources = append(env.varSources, source)
+}
+
+// varSource returns the source of the variables that are added by
+// `env.Vars[i]`.
+func (env *Env) varSource(i int) string {
+	if i < len(env.varSources) {
+		return env.varSources[i]
+	}
+	return fmt.Sprintf("Env.Vars[%d]", i)
+}
+
+// buildEnv returns the environment consisting of `base`, whose
+// entries come from `baseSource`, overridden by `overrides`, whose
+// entries come from the corresponding `sources`. The variables from
+// `base` keep their order, except that those that are overridden are
+// left out; then the overrides follow, in the order in which they
+// were first declared. If a variable is overridden more than once, the
+// last value wins. If `trace` is set, it also returns the trace of the
+// environment.
+func buildEnv(
+	base []string, baseSource string, overrides []EnvVar, sources []string, trace bool,
+) ([]string, EnvTrace) {
+	overridden := make(map[string]int, len(overrides))
+	var order []string
+	for i, v := range overrides {
+		if _, ok := overridden[v.Key]; !ok {
+			order = append(order, v.Key)
+		}
+		overridden[v.Key] = i
+	}
+
+	vars := make([]string, 0, len(base)+len(order))
+	var tr EnvTrace
+	baseEntries := make(map[string]string)
+	for _, kv := range base {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			vars = append(vars, kv)
+			continue
+		}
+		if _, ok := overridden[key]; ok {
+			baseEntries[key] = value
+			continue
+		}
+		vars = append(vars, kv)
+		if trace {
+			tr = append(tr, EnvTraceEntry{Key: key, Value: value, Source: baseSource})
+		}
+	}
+
+	for _, key := range order {
+		v := overrides[overridden[key]]
+		vars = append(vars, v.Key+"="+v.Value)
+		if !trace {
+			continue
+		}
+
+		e := EnvTraceEntry{Key: key, Value: v.Value}
+		if _, ok := baseEntries[key]; ok {
+			e.Overridden = append(e.Overridden, baseSource)
+		}
+		for i, o := range overrides {
+			if o.Key != key {
+				continue
+			}
+			if e.Source != "" {
+				e.Overridden = append(e.Overridden, e.Source)
+			}
+			e.Source = sources[i]
+		}
+		tr = append(tr, e)
+	}
+
+	return vars, tr
+}
+
+// withoutUnset returns `trace` without the variables that `f` unsets.
+func (trace EnvTrace) withoutUnset(f envFilter) EnvTrace {
+	if len(f.unset) == 0 {
+		return trace
+	}
+	result := make(EnvTrace, 0, len(trace))
+	for _, e := range trace {
+		if !f.unsets(e.Key) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
@@ -0,0 +1,104 @@
+package pipe_test
+
+import (
+	"context"
+	"os/exec"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/go-pipe/pipe"
+)
+
+func TestEnvOrder(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'env' unavailable")
+	}
+
+	t.Parallel()
+	ctx := context.Background()
+
+	for i := 0; i < 10; i++ {
+		cmd := exec.Command("env")
+		cmd.Env = []string{"ORIG1=a", "ORIG2=b", "ORIG3=c"}
+
+		p := pipe.New(
+			pipe.WithID("order"),
+			pipe.WithEnvVar("NEW1", "1"),
+			pipe.WithEnvVar("ORIG2", "2"),
+			pipe.WithEnvVars([]pipe.EnvVar{
+				{Key: "NEW2", Value: "3"},
+				{Key: "NEW3", Value: "4"},
+			}),
+			pipe.WithEnvVar("NEW1", "5"),
+		)
+		p.Add(pipe.CommandStage("env", cmd))
+		out, err := p.Output(ctx)
+		require.NoError(t, err)
+		assert.Equal(t,
+			"ORIG1=a\nORIG3=c\nGO_PIPE_ID=order\nGO_PIPE_STAGE_INDEX=0\n"+
+				"NEW1=5\nORIG2=2\nNEW2=3\nNEW3=4\n",
+			string(out),
+		)
+	}
+}
+
+func TestWithEnvTrace(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'true' unavailable")
+	}
+
+	t.Parallel()
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	traces := make(map[string]pipe.EnvTrace)
+
+	cmd := exec.Command("true")
+	cmd.Env = []string{"ORIG1=a", "ORIG2=b", "SECRET=x"}
+
+	p := pipe.New(
+		pipe.WithIDEnvVar("TRACE_PIPELINE_ID"),
+		pipe.WithID("trace"),
+		pipe.WithEnvTrace(func(stage string, trace pipe.EnvTrace) {
+			mu.Lock()
+			defer mu.Unlock()
+			traces[stage] = trace
+		}),
+		pipe.WithEnvVar("ORIG2", "1"),
+		pipe.WithEnvVarFunc("FROM_FUNC", func(context.Context) (string, bool) {
+			return "2", true
+		}),
+		pipe.WithEnvVarsFunc(func(context.Context) []pipe.EnvVar {
+			return []pipe.EnvVar{{Key: "ORIG2", Value: "3"}}
+		}),
+		pipe.WithUnsetEnv("SECRET"),
+	)
+	p.Add(
+		pipe.WithStageEnv(
+			pipe.CommandStage("first", cmd),
+			pipe.EnvVar{Key: "FROM_FUNC", Value: "4"},
+		),
+	)
+	require.NoError(t, p.Run(ctx))
+
+	assert.Equal(t,
+		pipe.EnvTrace{
+			{Key: "ORIG1", Value: "a", Source: "exec.Cmd.Env"},
+			{Key: "TRACE_PIPELINE_ID", Value: "trace", Source: "WithID"},
+			{Key: "GO_PIPE_STAGE_INDEX", Value: "0", Source: "WithStageIndexEnvVar"},
+			{
+				Key: "ORIG2", Value: "3", Source: "WithEnvVarsFunc",
+				Overridden: []string{"exec.Cmd.Env", `WithEnvVar("ORIG2")`},
+			},
+			{
+				Key: "FROM_FUNC", Value: "4", Source: "WithStageEnv",
+				Overridden: []string{`WithEnvVarFunc("FROM_FUNC")`},
+			},
+		},
+		traces["first"],
+	)
+}
@@ -0,0 +1,60 @@
+package pipe
+
+import "errors"
+
+// ErrLandlockUnavailable is the error returned when starting a command
+// stage that has a `FilesystemPolicy` on a system that doesn't
+// support Landlock, unless the policy is `BestEffort`.
+var ErrLandlockUnavailable = errors.New("landlock is not available")
+
+// FilesystemPolicy restricts which parts of the filesystem a command
+// stage may access, using Landlock (a Linux security module available
+// since Linux 5.13). It is a lighter-weight alternative to
+// `WithStageSandbox()`: the command still sees the whole filesystem,
+// but any access that the policy doesn't allow fails with `EACCES`.
+//
+// Each path grants access to the file or the whole directory tree at
+// that path. Access to `/dev/null` is always allowed. The policy is
+// inherited by all of the command's descendants, and can't be undone
+// by them.
+//
+// Landlock requires the `no_new_privs` attribute, so it is set on the
+// command, too. As a result, neither the command nor its descendants
+// can gain privileges by executing setuid or setgid programs (e.g.,
+// `sudo`) or programs with file capabilities.
+type FilesystemPolicy struct {
+	// ReadOnly are paths that may be read.
+	ReadOnly []string
+
+	// ReadWrite are paths that may be read, written, created, and
+	// removed.
+	ReadWrite []string
+
+	// Exec are paths that may be read and executed. They need to
+	// include the command itself and, for dynamically linked
+	// commands, the dynamic loader and shared libraries. If the stage
+	// has rlimits, they also need to include this program (see
+	// `WithRlimits()`).
+	Exec []string
+
+	// ReadWriteDir, if set, adds the command's directory (see
+	// `WithDir()`) to `ReadWrite`.
+	ReadWriteDir bool
+
+	// BestEffort, if set, runs the command unrestricted if Landlock
+	// is not available, instead of failing with
+	// `ErrLandlockUnavailable`. If the kernel supports an older
+	// version of Landlock, the restrictions that it supports are
+	// applied either way.
+	BestEffort bool
+}
+
+// WithStageFilesystemPolicy arranges for the command stage `stage` to
+// be restricted to the filesystem access allowed by `policy`. It
+// returns `stage`. It panics if `stage` is not a command stage. It
+// can't be combined with `WithStageSandbox()`.
+func WithStageFilesystemPolicy(stage Stage, policy FilesystemPolicy) Stage {
+	s := mustCommandStage(stage, "WithStageFilesystemPolicy")
+	s.fsPolicy = &policy
+	return stage
+}
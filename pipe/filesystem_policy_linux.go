@@ -0,0 +1,198 @@
+//go:build linux
+
+package pipe
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Landlock system calls and constants, which are missing from
+// `syscall`. See `linux/landlock.h`.
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1 << 0
+	landlockRulePathBeneath      = 1
+
+	prSetNoNewPrivs = 38
+	oPath           = 0x200000
+)
+
+// Landlock filesystem access rights.
+const (
+	llExecute    = 1 << 0
+	llWriteFile  = 1 << 1
+	llReadFile   = 1 << 2
+	llReadDir    = 1 << 3
+	llRemoveDir  = 1 << 4
+	llRemoveFile = 1 << 5
+	llMakeChar   = 1 << 6
+	llMakeDir    = 1 << 7
+	llMakeReg    = 1 << 8
+	llMakeSock   = 1 << 9
+	llMakeFifo   = 1 << 10
+	llMakeBlock  = 1 << 11
+	llMakeSym    = 1 << 12
+	llRefer      = 1 << 13 // ABI 2
+	llTruncate   = 1 << 14 // ABI 3
+	llIoctlDev   = 1 << 15 // ABI 5
+
+	// llFileRights are the rights that make sense for a file (as
+	// opposed to a directory).
+	llFileRights = llExecute | llWriteFile | llReadFile | llTruncate | llIoctlDev
+)
+
+type landlockRulesetAttr struct {
+	handledAccessFS uint64
+}
+
+// landlockPathBeneathAttr corresponds to the packed C struct
+// `landlock_path_beneath_attr`. The kernel only reads the first 12
+// bytes, so the padding at the end doesn't matter.
+type landlockPathBeneathAttr struct {
+	allowedAccess uint64
+	parentFD      int32
+}
+
+// landlockABIVersion returns the version of the Landlock ABI that the
+// kernel supports, or an error wrapping `ErrLandlockUnavailable`.
+func landlockABIVersion() (int, error) {
+	v, _, errno := syscall.RawSyscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return 0, fmt.Errorf("%w: %v", ErrLandlockUnavailable, errno)
+	}
+	return int(v), nil
+}
+
+// landlockHandledRights returns all of the filesystem access rights
+// known to Landlock ABI version `abi`.
+func landlockHandledRights(abi int) uint64 {
+	rights := uint64(llExecute | llWriteFile | llReadFile | llReadDir |
+		llRemoveDir | llRemoveFile | llMakeChar | llMakeDir | llMakeReg |
+		llMakeSock | llMakeFifo | llMakeBlock | llMakeSym)
+	if abi >= 2 {
+		rights |= llRefer
+	}
+	if abi >= 3 {
+		rights |= llTruncate
+	}
+	if abi >= 5 {
+		rights |= llIoctlDev
+	}
+	return rights
+}
+
+// restrictFilesystem restricts the current thread (and therefore the
+// command that is started from it) according to the command's
+// filesystem policy, if it has one. It must only be called on a
+// dedicated, locked OS thread that is discarded afterwards.
+func (s *commandStage) restrictFilesystem() error {
+	policy := s.fsPolicy
+	if policy == nil {
+		return nil
+	}
+
+	abi, err := landlockABIVersion()
+	if err != nil {
+		if policy.BestEffort {
+			return nil
+		}
+		return err
+	}
+	handled := landlockHandledRights(abi)
+
+	readOnly := uint64(llReadFile | llReadDir)
+	exec := readOnly | llExecute
+	readWrite := handled &^ llExecute
+
+	type rule struct {
+		path   string
+		rights uint64
+	}
+	var rules []rule
+	for _, path := range policy.ReadOnly {
+		rules = append(rules, rule{path, readOnly})
+	}
+	for _, path := range policy.Exec {
+		rules = append(rules, rule{path, exec})
+	}
+	for _, path := range policy.ReadWrite {
+		rules = append(rules, rule{path, readWrite})
+	}
+	if policy.ReadWriteDir {
+		dir := s.cmd.Dir
+		if dir == "" {
+			dir, err = os.Getwd()
+			if err != nil {
+				return fmt.Errorf("filesystem policy: %w", err)
+			}
+		}
+		rules = append(rules, rule{dir, readWrite})
+	}
+	// `exec.Cmd` opens `/dev/null` for any of the standard file
+	// descriptors that aren't otherwise set, and lots of programs
+	// expect to be able to use it:
+	rules = append(rules, rule{os.DevNull, readWrite})
+
+	attr := landlockRulesetAttr{handledAccessFS: handled}
+	fd, _, errno := syscall.RawSyscall(
+		sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0,
+	)
+	if errno != 0 {
+		return fmt.Errorf("filesystem policy: creating ruleset: %w", errno)
+	}
+	rulesetFD := int(fd)
+	defer syscall.Close(rulesetFD)
+
+	for _, r := range rules {
+		if err := addLandlockRule(rulesetFD, r.path, r.rights&handled); err != nil {
+			return fmt.Errorf("filesystem policy: %w", err)
+		}
+	}
+
+	// Required in order to restrict ourselves without
+	// `CAP_SYS_ADMIN`. Like the restriction itself, it only applies
+	// to this thread and its descendants:
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("filesystem policy: setting no_new_privs: %w", errno)
+	}
+
+	if _, _, errno := syscall.RawSyscall(sysLandlockRestrictSelf, uintptr(rulesetFD), 0, 0); errno != 0 {
+		return fmt.Errorf("filesystem policy: restricting thread: %w", errno)
+	}
+
+	return nil
+}
+
+// addLandlockRule adds a rule to the ruleset `rulesetFD` that allows
+// `rights` beneath `path`.
+func addLandlockRule(rulesetFD int, path string, rights uint64) error {
+	fd, err := syscall.Open(path, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("opening %q: %w", path, err)
+	}
+	defer syscall.Close(fd)
+
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return fmt.Errorf("stat %q: %w", path, err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		rights &= llFileRights
+	}
+
+	attr := landlockPathBeneathAttr{allowedAccess: rights, parentFD: int32(fd)}
+	_, _, errno := syscall.RawSyscall6(
+		sysLandlockAddRule, uintptr(rulesetFD), landlockRulePathBeneath,
+		uintptr(unsafe.Pointer(&attr)), 0, 0, 0,
+	)
+	if errno != 0 {
+		return fmt.Errorf("adding rule for %q: %w", path, errno)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package pipe_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/go-pipe/pipe"
+)
+
+// systemExecPaths returns the system directories needed to run
+// ordinary commands.
+func systemExecPaths() []string {
+	var paths []string
+	for _, dir := range []string{"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64"} {
+		if _, err := os.Stat(dir); err == nil {
+			paths = append(paths, dir)
+		}
+	}
+	return paths
+}
+
+// runRestricted runs `script` with `sh` under `policy`, skipping the
+// test if Landlock isn't available.
+func runRestricted(
+	t *testing.T, policy pipe.FilesystemPolicy, script string, options ...pipe.Option,
+) (string, error) {
+	t.Helper()
+
+	stdout := &bytes.Buffer{}
+	p := pipe.New(append(options, pipe.WithStdout(stdout))...)
+	p.Add(pipe.WithStageFilesystemPolicy(pipe.Command("sh", "-c", script), policy))
+	err := p.Run(context.Background())
+	if errors.Is(err, pipe.ErrLandlockUnavailable) {
+		t.Skipf("Landlock is not available: %v", err)
+	}
+	return stdout.String(), err
+}
+
+func TestFilesystemPolicy(t *testing.T) {
+	t.Parallel()
+
+	ro := t.TempDir()
+	rw := t.TempDir()
+	hidden := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(ro, "input"), []byte("allowed\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(hidden, "input"), []byte("secret\n"), 0o644))
+
+	// A copy of `sh` in a directory that is readable but not
+	// executable:
+	shData, err := os.ReadFile("/bin/sh")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(ro, "sh"), shData, 0o755))
+
+	policy := pipe.FilesystemPolicy{
+		ReadOnly:  []string{ro},
+		ReadWrite: []string{rw},
+		Exec:      systemExecPaths(),
+	}
+	out, err := runRestricted(
+		t, policy,
+		`cat `+ro+`/input`+
+			` && echo hello >`+rw+`/output`+
+			` && ! (echo oops >`+ro+`/output) 2>/dev/null`+
+			` && ! cat `+hidden+`/input 2>/dev/null`+
+			` && ! `+ro+`/sh -c true 2>/dev/null`+
+			` && echo done`,
+	)
+	require.NoError(t, err)
+	assert.Equal(t, "allowed\ndone\n", out)
+
+	data, err := os.ReadFile(filepath.Join(rw, "output"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", string(data))
+
+	_, err = os.Stat(filepath.Join(ro, "output"))
+	assert.True(t, os.IsNotExist(err))
+
+	// This process isn't affected:
+	_, err = os.ReadFile(filepath.Join(hidden, "input"))
+	assert.NoError(t, err)
+}
+
+func TestFilesystemPolicyReadWriteDir(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	policy := pipe.FilesystemPolicy{
+		Exec:         systemExecPaths(),
+		ReadWriteDir: true,
+	}
+	out, err := runRestricted(t, policy, `echo hello >output && cat output`, pipe.WithDir(dir))
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", out)
+}
+
+func TestFilesystemPolicyExecDenied(t *testing.T) {
+	t.Parallel()
+
+	// Without any exec paths, the command can't even be started:
+	_, err := runRestricted(t, pipe.FilesystemPolicy{}, `true`)
+	assert.ErrorIs(t, err, os.ErrPermission)
+}
+
+func TestFilesystemPolicyMissingPath(t *testing.T) {
+	t.Parallel()
+
+	policy := pipe.FilesystemPolicy{
+		ReadOnly: []string{filepath.Join(t.TempDir(), "does-not-exist")},
+		Exec:     systemExecPaths(),
+	}
+	_, err := runRestricted(t, policy, `true`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "filesystem policy: opening")
+	}
+}
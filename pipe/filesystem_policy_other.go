@@ -0,0 +1,13 @@
+//go:build !linux
+
+package pipe
+
+// restrictFilesystem fails if a filesystem policy was requested
+// (unless it is best-effort), because Landlock is only supported on
+// Linux.
+func (s *commandStage) restrictFilesystem() error {
+	if s.fsPolicy != nil && !s.fsPolicy.BestEffort {
+		return ErrLandlockUnavailable
+	}
+	return nil
+}
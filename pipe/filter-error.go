@@ -3,7 +3,6 @@ package pipe
 import (
 	"errors"
 	"io"
-	"os/exec"
 	"syscall"
 )
 
@@ -87,19 +86,14 @@ func IsError(target error) ErrorMatcher {
 
 // IsSIGPIPE returns an `ErrorMatcher` that matches `*exec.ExitError`s
 // that were caused by the specified signal. The match for
-// `*exec.ExitError`s uses `errors.As()`. Note that under Windows this
-// always returns false, because on that platform
-// `WaitStatus.Signaled()` isn't implemented (it is hardcoded to
-// return `false`).
+// `*exec.ExitError`s uses `errors.As()`. For sandboxed commands, the
+// wait status of the command itself is checked (see
+// `SandboxExitError`). Note that under Windows this always returns
+// false, because on that platform `WaitStatus.Signaled()` isn't
+// implemented (it is hardcoded to return `false`).
 func IsSignal(signal syscall.Signal) ErrorMatcher {
 	return func(err error) bool {
-		var eErr *exec.ExitError
-
-		if !errors.As(err, &eErr) {
-			return false
-		}
-
-		status, ok := eErr.Sys().(syscall.WaitStatus)
+		status, ok := exitWaitStatus(err)
 		return ok && status.Signaled() && status.Signal() == signal
 	}
 }
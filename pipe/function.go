@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"time"
 )
 
 // StageFunc is a function that can be used to power a `goStage`. It
@@ -50,6 +51,14 @@ func (s *goStage) SetPanicHandler(ph StagePanicHandler) {
 func (s *goStage) Start(ctx context.Context, env Env, stdin io.ReadCloser) (io.ReadCloser, error) {
 	r, w := io.Pipe()
 
+	start := time.Now()
+	emitEvent(env.eventHandler, &Event{
+		Command: s.name,
+		Msg:     "stage started",
+		Kind:    StageStarted,
+		Time:    start,
+	})
+
 	go func() {
 		defer func() {
 			// Cleanup resources on exit
@@ -61,12 +70,28 @@ func (s *goStage) Start(ctx context.Context, env Env, stdin io.ReadCloser) (io.R
 					s.err = fmt.Errorf("error closing stdin for stage %q: %w", s.Name(), err)
 				}
 			}
+			if env.eventHandler != nil {
+				env.eventHandler(stageExitedEvent(s.name, start, s.err))
+			}
 			close(s.done)
 		}()
 
 		defer s.recoverPanic()
 
-		s.err = s.f(ctx, env, stdin, w)
+		// Block reads and writes while the pipeline is paused:
+		var in io.Reader
+		var out io.Writer = w
+		if stdin != nil {
+			in = stdin
+		}
+		if env.gate != nil {
+			if stdin != nil {
+				in = gatedReader{ctx: ctx, gate: env.gate, r: stdin}
+			}
+			out = gatedWriter{ctx: ctx, gate: env.gate, w: w}
+		}
+
+		s.err = s.f(ctx, env, in, out)
 	}()
 
 	return r, nil
@@ -0,0 +1,44 @@
+package pipe
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// helperMainCalled is set to 1 once `HelperMain()` has been called.
+var helperMainCalled uint32
+
+// errNoHelperMain is the error returned when starting a command stage
+// that needs a helper process, if `HelperMain()` hasn't been called.
+var errNoHelperMain = errors.New("pipe.HelperMain() must be called at the start of main()")
+
+// HelperMain lets this program act as one of the helper processes that
+// this package uses to prepare some commands before executing them.
+// Such a helper is this program itself, re-executed via
+// `/proc/self/exe`. Programs that use `WithRlimits()` or
+// `WithStageSandbox()` must call `HelperMain()` at the very start of
+// `main()` (or, for tests, of `TestMain()`), before doing anything
+// else:
+//
+//	func main() {
+//		pipe.HelperMain()
+//		...
+//	}
+//
+// If this process was started as a helper, `HelperMain()` doesn't
+// return; otherwise, it returns immediately. Starting a stage that
+// needs a helper fails if `HelperMain()` hasn't been called.
+func HelperMain() {
+	atomic.StoreUint32(&helperMainCalled, 1)
+	runHelper()
+}
+
+// checkHelperMain returns an error if `HelperMain()` hasn't been
+// called, because a helper process would then run this program's
+// `main()` instead.
+func checkHelperMain() error {
+	if atomic.LoadUint32(&helperMainCalled) == 0 {
+		return errNoHelperMain
+	}
+	return nil
+}
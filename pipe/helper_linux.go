@@ -0,0 +1,15 @@
+//go:build linux
+
+package pipe
+
+import "os"
+
+// runHelper runs the helper that this process was started as, if any.
+func runHelper() {
+	if cfg, ok := os.LookupEnv(sandboxEnvVar); ok {
+		runSandboxInit(cfg)
+	}
+	if cfg, ok := os.LookupEnv(rlimitEnvVar); ok {
+		runRlimitHelper(cfg)
+	}
+}
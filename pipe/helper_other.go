@@ -0,0 +1,7 @@
+//go:build !linux
+
+package pipe
+
+// runHelper does nothing, because no helpers are used on this
+// platform.
+func runHelper() {}
@@ -0,0 +1,105 @@
+package pipe
+
+import (
+	"time"
+)
+
+// EventKind classifies lifecycle events. It is empty for other
+// events, like failures and memory warnings. Lifecycle events are only
+// passed to the pipeline's event handler if it is created
+// `WithLifecycleEvents()`.
+type EventKind string
+
+const (
+	// StageStarted is emitted when a stage has been started. For
+	// command stages, the context includes the process's "pid", its
+	// "argv", and its "dir".
+	StageStarted EventKind = "stage_started"
+
+	// StageExited is emitted when a stage is done. The context
+	// includes its "duration" and, for command stages, its
+	// "exit_code", its "signal" (if it was killed by one),
+	// "user_time", "system_time" and "max_rss". `Err` is the error
+	// that the stage failed with, if any.
+	StageExited EventKind = "stage_exited"
+
+	// StageKilled is emitted when a command stage is being killed.
+	// The context includes the "signal" that was sent and the
+	// "escalation_step" (1 for the initial signal, 2 if the command
+	// then had to be killed forcefully). `Err` is the reason, for
+	// example `context.Canceled`.
+	StageKilled EventKind = "stage_killed"
+
+	// PipelineStarted is emitted when all of a pipeline's stages have
+	// been started. The context includes the number of "stages".
+	PipelineStarted EventKind = "pipeline_started"
+
+	// PipelineFinished is emitted when a pipeline is done. The
+	// context includes its "duration". `Err` is the error returned by
+	// `Wait()`, if any.
+	PipelineFinished EventKind = "pipeline_finished"
+)
+
+// emitEvent passes `e` to `handler`, if it is set.
+func emitEvent(handler func(e *Event), e *Event) {
+	if handler != nil {
+		handler(e)
+	}
+}
+
+// stageExitedEvent returns a `StageExited` event for the stage named
+// `name`, which was started at `start` and failed with `err`
+// (possibly nil).
+func stageExitedEvent(name string, start time.Time, err error) *Event {
+	now := time.Now()
+	return &Event{
+		Command: name,
+		Msg:     "stage exited",
+		Err:     err,
+		Context: map[string]interface{}{
+			"duration": now.Sub(start),
+		},
+		Kind: StageExited,
+		Time: now,
+	}
+}
+
+// lifecycleEventHandler returns an event handler that passes events to
+// `handler`, except for lifecycle events if the pipeline wasn't
+// created `WithLifecycleEvents()`.
+func (p *Pipeline) lifecycleEventHandler(handler func(e *Event)) func(e *Event) {
+	if p.lifecycleEvents {
+		return handler
+	}
+
+	return func(e *Event) {
+		if e.Kind == "" {
+			handler(e)
+		}
+	}
+}
+
+// observingEventHandler returns an event handler that passes events
+// to the pipeline's observers before passing them to `handler`.
+func (p *Pipeline) observingEventHandler(handler func(e *Event)) func(e *Event) {
+	if len(p.observers) == 0 {
+		return handler
+	}
+
+	observers := p.observers
+	return func(e *Event) {
+		for _, observe := range observers {
+			observe(e)
+		}
+		handler(e)
+	}
+}
+
+// finish calls the pipeline's finishers. It must only be called once
+// the stages and the taps between them are done. `err` is the error
+// that the pipeline failed with, if any.
+func (p *Pipeline) finish(err error) {
+	for _, f := range p.finishers {
+		f(err)
+	}
+}
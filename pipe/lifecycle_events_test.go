@@ -0,0 +1,162 @@
+package pipe_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/go-pipe/pipe"
+)
+
+// lifecycleRecorder records the lifecycle events of a pipeline.
+type lifecycleRecorder struct {
+	mu     sync.Mutex
+	events []*pipe.Event
+}
+
+func (r *lifecycleRecorder) handle(e *pipe.Event) {
+	if e.Kind == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+// find returns the events of kind `kind` for the stage named
+// `command`.
+func (r *lifecycleRecorder) find(kind pipe.EventKind, command string) []*pipe.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var events []*pipe.Event
+	for _, e := range r.events {
+		if e.Kind == kind && e.Command == command {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'sh' unavailable")
+	}
+
+	t.Parallel()
+	ctx := context.Background()
+
+	var rec lifecycleRecorder
+	p := pipe.New(
+		pipe.WithID("lifecycle"), pipe.WithEventHandler(rec.handle), pipe.WithLifecycleEvents(),
+	)
+	p.Add(
+		pipe.Command("sh", "-c", "echo hello; exit 3"),
+		pipe.Function(
+			"discard",
+			func(_ context.Context, _ pipe.Env, stdin io.Reader, _ io.Writer) error {
+				_, err := io.Copy(io.Discard, stdin)
+				return err
+			},
+		),
+	)
+	err := p.Run(ctx)
+	require.Error(t, err)
+
+	for _, e := range rec.events {
+		assert.Equal(t, "lifecycle", e.PipelineID)
+		assert.False(t, e.Time.IsZero())
+	}
+
+	started := rec.find(pipe.PipelineStarted, "pipeline")
+	require.Len(t, started, 1)
+	assert.Equal(t, 2, started[0].Context["stages"])
+
+	shStarted := rec.find(pipe.StageStarted, "sh")
+	require.Len(t, shStarted, 1)
+	assert.Positive(t, shStarted[0].Context["pid"])
+	assert.Equal(t, 0, shStarted[0].Context["stage_index"])
+
+	shExited := rec.find(pipe.StageExited, "sh")
+	require.Len(t, shExited, 1)
+	assert.Equal(t, 3, shExited[0].Context["exit_code"])
+	assert.Error(t, shExited[0].Err)
+	assert.IsType(t, time.Duration(0), shExited[0].Context["duration"])
+	assert.Contains(t, shExited[0].Context, "user_time")
+	assert.Contains(t, shExited[0].Context, "max_rss")
+
+	require.Len(t, rec.find(pipe.StageStarted, "discard"), 1)
+	discardExited := rec.find(pipe.StageExited, "discard")
+	require.Len(t, discardExited, 1)
+	assert.NoError(t, discardExited[0].Err)
+	assert.Equal(t, 1, discardExited[0].Context["stage_index"])
+
+	finished := rec.find(pipe.PipelineFinished, "pipeline")
+	require.Len(t, finished, 1)
+	assert.Equal(t, err, finished[0].Err)
+
+	// `PipelineFinished` comes last:
+	assert.Equal(t, pipe.PipelineFinished, rec.events[len(rec.events)-1].Kind)
+}
+
+func TestLifecycleEventsKilled(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'sleep' unavailable")
+	}
+
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var rec lifecycleRecorder
+	p := pipe.New(pipe.WithEventHandler(rec.handle), pipe.WithLifecycleEvents())
+	p.Add(pipe.Command("sleep", "10"))
+	require.NoError(t, p.Start(ctx))
+	cancel()
+	assert.ErrorIs(t, p.Wait(), context.Canceled)
+
+	killed := rec.find(pipe.StageKilled, "sleep")
+	require.Len(t, killed, 1)
+	assert.ErrorIs(t, killed[0].Err, context.Canceled)
+	assert.Equal(t, "terminated", killed[0].Context["signal"])
+	assert.Equal(t, 1, killed[0].Context["escalation_step"])
+	assert.Equal(t, p.ID(), killed[0].PipelineID)
+
+	exited := rec.find(pipe.StageExited, "sleep")
+	require.Len(t, exited, 1)
+	assert.Equal(t, "terminated", exited[0].Context["signal"])
+	assert.Equal(t, -1, exited[0].Context["exit_code"])
+}
+
+func TestLifecycleEventsOptIn(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	var rec lifecycleRecorder
+	p := pipe.New(pipe.WithEventHandler(rec.handle))
+	p.Add(pipe.Function(
+		"noop",
+		func(context.Context, pipe.Env, io.Reader, io.Writer) error {
+			return nil
+		},
+	))
+	require.NoError(t, p.Run(ctx))
+	assert.Empty(t, rec.events)
+
+	// The stage that copies the output to stdout isn't counted:
+	var stdout bytes.Buffer
+	p = pipe.New(
+		pipe.WithEventHandler(rec.handle), pipe.WithLifecycleEvents(), pipe.WithStdout(&stdout),
+	)
+	p.Add(seqFunction(10))
+	require.NoError(t, p.Run(ctx))
+	started := rec.find(pipe.PipelineStarted, "pipeline")
+	require.Len(t, started, 1)
+	assert.Equal(t, 1, started[0].Context["stages"])
+}
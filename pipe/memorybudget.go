@@ -0,0 +1,174 @@
+package pipe
+
+import (
+	"context"
+	"fmt"
+)
+
+// MemoryBudgetPolicy decides what happens when a pipeline exceeds the
+// memory budget set by `WithPipelineMemoryLimit()`.
+type MemoryBudgetPolicy int
+
+const (
+	// KillLargestStage kills only the stage that is using the most
+	// memory.
+	KillLargestStage MemoryBudgetPolicy = iota
+
+	// KillAllStages kills every stage whose memory use is being
+	// watched.
+	KillAllStages
+)
+
+func (p MemoryBudgetPolicy) String() string {
+	switch p {
+	case KillLargestStage:
+		return "kill-largest"
+	case KillAllStages:
+		return "kill-all"
+	default:
+		return fmt.Sprintf("MemoryBudgetPolicy(%d)", int(p))
+	}
+}
+
+// StageMemoryUsage is one entry of the per-stage breakdown that is
+// included (under the key "stages") in the `Context` of the event
+// emitted when a pipeline exceeds its memory budget.
+type StageMemoryUsage struct {
+	Stage string
+
+	// Index is the index of the stage in the pipeline, which
+	// distinguishes stages that have the same name.
+	Index int
+
+	RSSAnon uint64
+}
+
+// budgetStage is a stage whose memory use counts towards a pipeline's
+// memory budget.
+type budgetStage struct {
+	index int
+	stage LimitableStage
+}
+
+// memoryBudget watches the combined memory use of the
+// `LimitableStage`s in a pipeline.
+type memoryBudget struct {
+	byteLimit uint64
+	policy    MemoryBudgetPolicy
+	options   []SamplerOption
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+// WithPipelineMemoryLimit sets a memory budget for the pipeline as a
+// whole. While the pipeline is running, the `RSSAnon` of every stage
+// that implements `LimitableStage` is sampled, and if their sum
+// reaches `byteLimit`, an event with a per-stage breakdown is emitted
+// and stages are killed with `ErrMemoryLimitExceeded` according to
+// `policy`. Stages that can't be sampled (e.g., because they have
+// already exited) count as using no memory. Stages that have been
+// killed aren't sampled any more, but the budget is still enforced for
+// the others. `options` can be used to configure the sampling interval
+// and clock; watchers are ignored.
+func WithPipelineMemoryLimit(
+	byteLimit uint64, policy MemoryBudgetPolicy, options ...SamplerOption,
+) Option {
+	return func(p *Pipeline) {
+		p.memoryBudget = &memoryBudget{
+			byteLimit: byteLimit,
+			policy:    policy,
+			options:   options,
+		}
+	}
+}
+
+// start starts watching `stages` in the background.
+func (b *memoryBudget) start(ctx context.Context, stages []Stage, eventHandler func(e *Event)) {
+	var limitable []budgetStage
+	for i, s := range stages {
+		if ls, ok := asLimitableStage(s); ok {
+			limitable = append(limitable, budgetStage{index: i, stage: ls})
+		}
+	}
+
+	ctx, b.cancel = context.WithCancel(ctx)
+	b.done = make(chan struct{})
+
+	go func() {
+		defer close(b.done)
+		b.watch(ctx, limitable, eventHandler)
+	}()
+}
+
+// stop stops watching and waits for the watcher to finish.
+func (b *memoryBudget) stop() {
+	if b.cancel == nil {
+		return
+	}
+	b.cancel()
+	<-b.done
+}
+
+func (b *memoryBudget) watch(ctx context.Context, stages []budgetStage, eventHandler func(e *Event)) {
+	rs := NewResourceSampler(eventHandler, b.options...)
+	t := rs.clock.NewTicker(rs.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C():
+			var total uint64
+			breakdown := make([]StageMemoryUsage, len(stages))
+			for i, s := range stages {
+				rss, _ := s.stage.GetRSSAnon(ctx)
+				breakdown[i] = StageMemoryUsage{
+					Stage:   s.stage.Name(),
+					Index:   s.index,
+					RSSAnon: rss,
+				}
+				total += rss
+			}
+			if len(stages) == 0 || total < b.byteLimit {
+				continue
+			}
+
+			eventHandler(&Event{
+				Command: "pipeline",
+				Msg:     "pipeline exceeded memory budget",
+				Err:     fmt.Errorf("pipeline exceeded memory budget"),
+				Context: map[string]interface{}{
+					"limit":  b.byteLimit,
+					"used":   total,
+					"policy": b.policy.String(),
+					"stages": breakdown,
+				},
+			})
+			stages = b.kill(stages, breakdown)
+		}
+	}
+}
+
+// kill kills stages according to the budget's policy, and returns the
+// stages that are left running.
+func (b *memoryBudget) kill(stages []budgetStage, breakdown []StageMemoryUsage) []budgetStage {
+	if b.policy == KillAllStages {
+		for _, s := range stages {
+			s.stage.Kill(ErrMemoryLimitExceeded)
+		}
+		return nil
+	}
+
+	largest := 0
+	for i := range breakdown {
+		if breakdown[i].RSSAnon > breakdown[largest].RSSAnon {
+			largest = i
+		}
+	}
+	stages[largest].stage.Kill(ErrMemoryLimitExceeded)
+
+	remaining := make([]budgetStage, 0, len(stages)-1)
+	remaining = append(remaining, stages[:largest]...)
+	return append(remaining, stages[largest+1:]...)
+}
@@ -0,0 +1,145 @@
+package pipe_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/go-pipe/pipe"
+)
+
+// testMemoryBudget runs a pipeline of three stages whose combined
+// memory use exceeds the budget on the second sample. It waits for the
+// stages whose indexes are listed in `killed` to be killed, then lets
+// the others finish.
+func testMemoryBudget(
+	t *testing.T, policy pipe.MemoryBudgetPolicy, killed ...int,
+) (*eventRecorder, []*fakeLimitableStage, error) {
+	t.Helper()
+	ctx := context.Background()
+
+	clock := newManualClock()
+	stages := []*fakeLimitableStage{
+		newFakeLimitableStage(), newFakeLimitableStage(), newFakeLimitableStage(),
+	}
+	var rec eventRecorder
+
+	p := pipe.New(
+		pipe.WithEventHandler(rec.handle),
+		pipe.WithPipelineMemoryLimit(1000, policy, pipe.WithClock(clock)),
+	)
+	for _, s := range stages {
+		p.Add(s)
+	}
+	require.NoError(t, p.Start(ctx))
+
+	sampleAll := func(rss ...uint64) {
+		clock.Tick()
+		for i, s := range stages {
+			s.results <- sampleResult{usage: pipe.ResourceUsage{RSSAnon: rss[i]}}
+		}
+	}
+
+	sampleAll(100, 200, 300)
+	sampleAll(300, 500, 200)
+
+	for _, i := range killed {
+		<-stages[i].done
+	}
+	for _, s := range stages {
+		s.finish()
+	}
+
+	return &rec, stages, p.Wait()
+}
+
+func TestPipelineMemoryLimitKillLargest(t *testing.T) {
+	t.Parallel()
+
+	rec, stages, err := testMemoryBudget(t, pipe.KillLargestStage, 1)
+	assert.ErrorIs(t, err, pipe.ErrMemoryLimitExceeded)
+
+	assert.NoError(t, stages[0].killErr)
+	assert.ErrorIs(t, stages[1].killErr, pipe.ErrMemoryLimitExceeded)
+	assert.NoError(t, stages[2].killErr)
+
+	e := rec.events[0]
+	assert.Equal(t, "pipeline exceeded memory budget", e.Msg)
+	assert.EqualValues(t, 1000, e.Context["limit"])
+	assert.EqualValues(t, 1000, e.Context["used"])
+	assert.Equal(t, "kill-largest", e.Context["policy"])
+	assert.Equal(t,
+		[]pipe.StageMemoryUsage{
+			{Stage: "fake", Index: 0, RSSAnon: 300},
+			{Stage: "fake", Index: 1, RSSAnon: 500},
+			{Stage: "fake", Index: 2, RSSAnon: 200},
+		},
+		e.Context["stages"],
+	)
+}
+
+func TestPipelineMemoryLimitKillAll(t *testing.T) {
+	t.Parallel()
+
+	rec, stages, err := testMemoryBudget(t, pipe.KillAllStages, 0, 1, 2)
+	assert.ErrorIs(t, err, pipe.ErrMemoryLimitExceeded)
+
+	for _, s := range stages {
+		assert.ErrorIs(t, s.killErr, pipe.ErrMemoryLimitExceeded)
+	}
+	assert.Equal(t, "kill-all", rec.events[0].Context["policy"])
+}
+
+func TestPipelineMemoryLimitKeepsWatching(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	clock := newManualClock()
+	stages := []*fakeLimitableStage{
+		newFakeLimitableStage(), newFakeLimitableStage(), newFakeLimitableStage(),
+	}
+	var rec eventRecorder
+
+	p := pipe.New(
+		pipe.WithEventHandler(rec.handle),
+		pipe.WithPipelineMemoryLimit(1000, pipe.KillLargestStage, pipe.WithClock(clock)),
+	)
+	for _, s := range stages {
+		p.Add(s)
+	}
+	require.NoError(t, p.Start(ctx))
+
+	clock.Tick()
+	for i, rss := range []uint64{300, 800, 200} {
+		stages[i].results <- sampleResult{usage: pipe.ResourceUsage{RSSAnon: rss}}
+	}
+	<-stages[1].done
+
+	// The killed stage isn't sampled any more:
+	clock.Tick()
+	stages[0].results <- sampleResult{usage: pipe.ResourceUsage{RSSAnon: 700}}
+	stages[2].results <- sampleResult{usage: pipe.ResourceUsage{RSSAnon: 400}}
+	<-stages[0].done
+
+	stages[2].finish()
+	assert.ErrorIs(t, p.Wait(), pipe.ErrMemoryLimitExceeded)
+	assert.NoError(t, stages[2].killErr)
+
+	assert.Equal(t,
+		[]string{
+			"pipeline exceeded memory budget",
+			"pipeline exceeded memory budget",
+			"command failed",
+		},
+		rec.msgs(),
+	)
+	assert.Equal(t,
+		[]pipe.StageMemoryUsage{
+			{Stage: "fake", Index: 0, RSSAnon: 700},
+			{Stage: "fake", Index: 2, RSSAnon: 400},
+		},
+		rec.events[1].Context["stages"],
+	)
+}
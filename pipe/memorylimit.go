@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"sync"
 	"time"
 )
@@ -16,7 +17,7 @@ const memoryPollInterval = time.Second
 var ErrMemoryLimitExceeded = errors.New("memory limit exceeded")
 
 // LimitableStage is the superset of Stage that must be implemented by stages
-// passed to MemoryLimit and MemoryObserver.
+// passed to MemoryLimit, MemoryObserver, and SampleResources.
 type LimitableStage interface {
 	Stage
 
@@ -25,8 +26,11 @@ type LimitableStage interface {
 }
 
 // MemoryLimit watches the memory usage of the stage and stops it if it
-// exceeds the given limit.
-func MemoryLimit(stage Stage, byteLimit uint64, eventHandler func(e *Event)) Stage {
+// exceeds the given limit. `options` can be used to configure the
+// sampling, e.g., its interval or clock.
+func MemoryLimit(
+	stage Stage, byteLimit uint64, eventHandler func(e *Event), options ...SamplerOption,
+) Stage {
 
 	limitableStage, ok := stage.(LimitableStage)
 	if !ok {
@@ -38,60 +42,28 @@ func MemoryLimit(stage Stage, byteLimit uint64, eventHandler func(e *Event)) Sta
 		return stage
 	}
 
+	events := newStageEvents(eventHandler)
 	return &memoryWatchStage{
 		nameSuffix: " with memory limit",
 		stage:      limitableStage,
-		watch:      killAtLimit(byteLimit, eventHandler),
-	}
-}
-
-func killAtLimit(byteLimit uint64, eventHandler func(e *Event)) memoryWatchFunc {
-	return func(ctx context.Context, stage LimitableStage) {
-		var consecutiveErrors int
-
-		t := time.NewTicker(memoryPollInterval)
-		defer t.Stop()
-
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-t.C:
-				rss, err := stage.GetRSSAnon(ctx)
-				if err != nil {
-					consecutiveErrors++
-					if consecutiveErrors >= 2 {
-						eventHandler(&Event{
-							Command: stage.Name(),
-							Msg:     "error getting RSS",
-							Err:     err,
-						})
-					}
-					continue
-				}
-				consecutiveErrors = 0
-				if rss < byteLimit {
-					continue
-				}
-				eventHandler(&Event{
-					Command: stage.Name(),
-					Msg:     "stage exceeded allowed memory use",
-					Err:     fmt.Errorf("stage exceeded allowed memory use"),
-					Context: map[string]interface{}{
-						"limit": byteLimit,
-						"used":  rss,
-					},
-				})
-				stage.Kill(ErrMemoryLimitExceeded)
-				return
-			}
-		}
+		events:     events,
+		watch: NewResourceSampler(
+			events.handle,
+			append(
+				[]SamplerOption{
+					WithWatchers(KillAtMemoryLimit(byteLimit, events.handle)),
+					WithEveryErrorReported(),
+				},
+				options...,
+			)...,
+		).Run,
 	}
 }
 
 // MemoryObserver watches memory use of the stage and logs the maximum
-// value when the stage exits.
-func MemoryObserver(stage Stage, eventHandler func(e *Event)) Stage {
+// value when the stage exits. `options` can be used to configure the
+// sampling, e.g., its interval or clock.
+func MemoryObserver(stage Stage, eventHandler func(e *Event), options ...SamplerOption) Stage {
 	limitableStage, ok := stage.(LimitableStage)
 	if !ok {
 		eventHandler(&Event{
@@ -102,66 +74,82 @@ func MemoryObserver(stage Stage, eventHandler func(e *Event)) Stage {
 		return stage
 	}
 
+	events := newStageEvents(eventHandler)
 	return &memoryWatchStage{
-		stage: limitableStage,
-		watch: logMaxRSS(eventHandler),
+		stage:  limitableStage,
+		events: events,
+		watch: NewResourceSampler(
+			events.handle,
+			append([]SamplerOption{WithWatchers(ObservePeakUsage(events.handle))}, options...)...,
+		).Run,
 	}
 }
 
-func logMaxRSS(eventHandler func(e *Event)) memoryWatchFunc {
-
-	return func(ctx context.Context, stage LimitableStage) {
-		var (
-			maxRSS                             uint64
-			samples, errors, consecutiveErrors int
-		)
-
-		t := time.NewTicker(memoryPollInterval)
-		defer t.Stop()
-
-		for {
-			select {
-			case <-ctx.Done():
-				eventHandler(&Event{
-					Command: stage.Name(),
-					Msg:     "peak memory usage",
-					Context: map[string]interface{}{
-						"max_rss_bytes": maxRSS,
-						"samples":       samples,
-						"errors":        errors,
-					},
-				})
-
-				return
-			case <-t.C:
-				rss, err := stage.GetRSSAnon(ctx)
-				if err != nil {
-					errors++
-					consecutiveErrors++
-					if consecutiveErrors == 2 {
-						eventHandler(&Event{
-							Command: stage.Name(),
-							Msg:     "error getting RSS",
-							Err:     err,
-						})
-					}
-					// don't log any more errors until we get rss successfully.
-					continue
-				}
-
-				consecutiveErrors = 0
-				samples++
-				if rss > maxRSS {
-					maxRSS = rss
-				}
-			}
-		}
+// MemoryTiers configures the two tiers of a `TieredMemoryLimit`.
+type MemoryTiers struct {
+	// Soft is the soft limit, in bytes. When the stage's memory use
+	// reaches it, an event is emitted and `SoftSignal` (if set) is
+	// sent to the stage. Zero disables the soft tier.
+	Soft uint64
+
+	// SoftSignal is the signal (e.g., `syscall.SIGUSR1`) that is sent
+	// to the stage when it reaches the soft limit, or nil if no
+	// signal should be sent.
+	SoftSignal os.Signal
+
+	// Hard is the hard limit, in bytes. When the stage's memory use
+	// reaches it, the stage is killed, as with `MemoryLimit`. Zero
+	// disables the hard tier.
+	Hard uint64
+}
+
+// TieredMemoryLimit watches the memory usage of the stage. When it
+// reaches the soft limit, the stage is warned; when it reaches the
+// hard limit, the stage is stopped. Each tier emits its own event,
+// whose `Context` includes the "limit", the bytes "used", and the
+// "tier" ("soft" or "hard"). `options` can be used to configure the
+// sampling, e.g., its interval; any watchers that they add are applied
+// after the two tiers.
+func TieredMemoryLimit(
+	stage Stage, tiers MemoryTiers, eventHandler func(e *Event), options ...SamplerOption,
+) Stage {
+	limitableStage, ok := stage.(LimitableStage)
+	if !ok {
+		eventHandler(&Event{
+			Command: stage.Name(),
+			Msg:     "invalid pipe.TieredMemoryLimit usage",
+			Err:     fmt.Errorf("invalid pipe.TieredMemoryLimit usage"),
+		})
+		return stage
+	}
+
+	events := newStageEvents(eventHandler)
+	var watchers []ResourceWatcher
+	if tiers.Soft != 0 {
+		watchers = append(watchers, SoftMemoryLimit(tiers.Soft, tiers.SoftSignal, events.handle))
+	}
+	if tiers.Hard != 0 {
+		watchers = append(watchers, &limitWatcher{
+			byteLimit:    tiers.Hard,
+			eventHandler: events.handle,
+			tier:         "hard",
+		})
+	}
+
+	return &memoryWatchStage{
+		nameSuffix: " with memory limit",
+		stage:      limitableStage,
+		events:     events,
+		watch: NewResourceSampler(
+			events.handle, append([]SamplerOption{WithWatchers(watchers...)}, options...)...,
+		).Run,
 	}
 }
 
 type memoryWatchStage struct {
 	nameSuffix string
 	stage      LimitableStage
+	events     *stageEvents
 	watch      memoryWatchFunc
 	cancel     context.CancelFunc
 	wg         sync.WaitGroup
@@ -169,7 +157,11 @@ type memoryWatchStage struct {
 
 type memoryWatchFunc func(context.Context, LimitableStage)
 
-var _ LimitableStage = (*memoryWatchStage)(nil)
+var (
+	_ LimitableStage   = (*memoryWatchStage)(nil)
+	_ ResourceReporter = (*memoryWatchStage)(nil)
+	_ SignalableStage  = (*memoryWatchStage)(nil)
+)
 
 func (m *memoryWatchStage) Name() string {
 	return m.stage.Name() + m.nameSuffix
@@ -181,6 +173,10 @@ func (m *memoryWatchStage) Start(ctx context.Context, env Env, stdin io.ReadClos
 		return nil, err
 	}
 
+	if m.events != nil {
+		m.events.start(env)
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
 	m.cancel = cancel
 	m.wg.Add(1)
@@ -205,6 +201,18 @@ func (m *memoryWatchStage) GetRSSAnon(ctx context.Context) (uint64, error) {
 	return m.stage.GetRSSAnon(ctx)
 }
 
+func (m *memoryWatchStage) GetResourceUsage(ctx context.Context) (ResourceUsage, error) {
+	return sample(ctx, m.stage)
+}
+
+func (m *memoryWatchStage) Signal(sig os.Signal) error {
+	ss, ok := m.stage.(SignalableStage)
+	if !ok {
+		return fmt.Errorf("stage %q cannot be signaled", m.stage.Name())
+	}
+	return ss.Signal(sig)
+}
+
 func (m *memoryWatchStage) Kill(err error) {
 	m.stage.Kill(err)
 	m.stopWatching()
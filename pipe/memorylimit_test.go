@@ -9,7 +9,6 @@ import (
 	"os"
 	"strings"
 	"testing"
-	"time"
 
 	"github.com/github/go-pipe/pipe"
 	"github.com/stretchr/testify/assert"
@@ -59,8 +58,9 @@ func testMemoryObserver(t *testing.T, mbs int, stage pipe.Stage) int {
 	buf := &bytes.Buffer{}
 	logger := log.New(buf, "testMemoryObserver", log.Ldate|log.Ltime)
 
+	clock := newManualClock()
 	p := pipe.New(pipe.WithDir("/"), pipe.WithStdin(stdinReader), pipe.WithStdout(devNull))
-	p.Add(pipe.MemoryObserver(stage, LogEventHandler(logger)))
+	p.Add(pipe.MemoryObserver(stage, LogEventHandler(logger), pipe.WithClock(clock)))
 	require.NoError(t, p.Start(ctx))
 
 	// Write some nonsense data to less, but don't close stdin until we want it
@@ -72,9 +72,10 @@ func testMemoryObserver(t *testing.T, mbs int, stage pipe.Stage) int {
 		require.Equal(t, len(bytes), n)
 	}
 
-	// MemoryObserver polls every one second, so this should make sure we catch
-	// at least one.
-	time.Sleep(2 * time.Second)
+	// The second tick is only received once the sample that the first
+	// one triggered has been taken.
+	clock.Tick()
+	clock.Tick()
 
 	// Close stdin and wait for the pipeline to exit.
 	require.NoError(t, stdinWriter.Close())
@@ -146,16 +147,24 @@ func testMemoryLimit(t *testing.T, mbs int, limit uint64, stage pipe.Stage) (str
 	buf := &bytes.Buffer{}
 	logger := log.New(buf, "testMemoryObserver", log.Ldate|log.Ltime)
 
+	clock := newManualClock()
 	p := pipe.New(pipe.WithDir("/"), pipe.WithStdin(stdinReader), pipe.WithStdoutCloser(stdout))
-	p.Add(pipe.MemoryLimit(stage, limit, LogEventHandler(logger)))
+	p.Add(pipe.MemoryLimit(stage, limit, LogEventHandler(logger), pipe.WithClock(clock)))
 	require.NoError(t, p.Start(ctx))
 
-	// Write some nonsense data to less.
+	// Write some nonsense data to less. Once the limit has been
+	// exceeded, sample its memory use, which should get it killed
+	// while we are still writing. (The sampler stops after killing
+	// the stage, so there mustn't be another tick.)
 	var bytes [1_000_000]byte
 	for i := 0; i < mbs; i++ {
+		if uint64(i)*uint64(len(bytes)) == 2*limit {
+			clock.Tick()
+		}
 		_, err := stdinWriter.Write(bytes[:])
 		if err != nil {
 			require.ErrorIs(t, err, closedErr)
+			break
 		}
 	}
 
@@ -0,0 +1,263 @@
+// Package metricspipe collects metrics about the stages of
+// `pipe.Pipeline`s, and exposes them in the Prometheus text format.
+//
+// Metrics are labeled by stage name. For stages created using
+// `pipe.Command()`, that is the name of the command, which keeps the
+// number of label values small.
+package metricspipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/github/go-pipe/pipe"
+)
+
+// Failure classes, used as the "class" label of
+// `pipe_stage_failures_total`.
+const (
+	ClassPipe        = "pipe"
+	ClassSignal      = "signal"
+	ClassExitCode    = "exit_code"
+	ClassMemoryLimit = "memory_limit"
+	ClassContext     = "context"
+	ClassOther       = "other"
+)
+
+// DefaultBuckets are the default upper bounds of the buckets of the
+// stage-duration histogram, in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Collector collects metrics about the stages of the pipelines that it
+// is attached to (using `Collector.Option()`). It implements
+// `http.Handler`, serving the metrics in the Prometheus text format:
+//
+//   - pipe_stage_runs_total: the number of times that each stage was
+//     started;
+//   - pipe_stage_failures_total: the number of times that each stage
+//     failed, by failure class (see `Classify()`). Errors that are
+//     suppressed using `pipe.FilterError()` or `pipe.IgnoreError()`
+//     don't count;
+//   - pipe_stage_duration_seconds: a histogram of how long each stage
+//     ran;
+//   - pipe_stage_bytes_in_total and pipe_stage_bytes_out_total: the
+//     number of bytes that each stage read from the previous stage and
+//     passed to the next one. These are only counted for pipelines that
+//     are also created `pipe.WithIOInstrumentation()`.
+type Collector struct {
+	buckets []float64
+
+	mu     sync.Mutex
+	stages map[string]*stageMetrics
+}
+
+// stageMetrics are the metrics of the stages with a particular name.
+type stageMetrics struct {
+	runs     uint64
+	failures map[string]uint64
+	bytesIn  int64
+	bytesOut int64
+
+	// durationBuckets holds the (non-cumulative) count for each of
+	// the collector's buckets, plus one for +Inf.
+	durationBuckets []uint64
+	durationSum     float64
+	durationCount   uint64
+}
+
+// NewCollector returns a new `Collector`. `buckets` are the upper
+// bounds of the buckets of the stage-duration histogram, in seconds,
+// in increasing order; if none are given, `DefaultBuckets` are used.
+func NewCollector(buckets ...float64) *Collector {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	if !sort.Float64sAreSorted(buckets) {
+		panic("metricspipe.NewCollector: buckets must be in increasing order")
+	}
+
+	return &Collector{
+		buckets: append([]float64(nil), buckets...),
+		stages:  make(map[string]*stageMetrics),
+	}
+}
+
+// Option returns a `pipe.Option` that makes the pipeline report its
+// stats to `c`.
+func (c *Collector) Option() pipe.Option {
+	return pipe.WithStatsHandler(c.Observe)
+}
+
+// Observe records the stats of a pipeline. It is called automatically
+// for pipelines that use `c.Option()`.
+func (c *Collector) Observe(stats *pipe.PipelineStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, s := range stats.Stages {
+		if !s.Started {
+			continue
+		}
+
+		m, ok := c.stages[s.Name]
+		if !ok {
+			m = &stageMetrics{
+				failures:        make(map[string]uint64),
+				durationBuckets: make([]uint64, len(c.buckets)+1),
+			}
+			c.stages[s.Name] = m
+		}
+
+		m.runs++
+		if class := Classify(s.Err); class != "" {
+			m.failures[class]++
+		}
+		m.bytesIn += s.BytesIn
+		m.bytesOut += s.BytesOut
+
+		seconds := s.Duration.Seconds()
+		m.durationBuckets[sort.SearchFloat64s(c.buckets, seconds)]++
+		m.durationSum += seconds
+		m.durationCount++
+	}
+}
+
+// Classify returns the failure class of a stage that failed with
+// `err`, or the empty string if `err` doesn't count as a failure (that
+// is, if it is nil or `pipe.FinishEarly`). Sandboxed commands that were
+// killed by a signal are classified by the wait status of the command
+// itself (see `pipe.SandboxExitError`), not by the exit status of the
+// sandbox's init process.
+func Classify(err error) string {
+	var sErr *pipe.SandboxExitError
+	var eErr *exec.ExitError
+	switch {
+	case err == nil, errors.Is(err, pipe.FinishEarly):
+		return ""
+	case pipe.IsPipeError(err):
+		return ClassPipe
+	case errors.Is(err, pipe.ErrMemoryLimitExceeded), errors.Is(err, pipe.ErrOOMKilled):
+		return ClassMemoryLimit
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return ClassContext
+	case errors.As(err, &sErr):
+		if sErr.WaitStatus.Signaled() {
+			return ClassSignal
+		}
+		return ClassExitCode
+	case errors.As(err, &eErr):
+		if eErr.ExitCode() == -1 {
+			return ClassSignal
+		}
+		return ClassExitCode
+	default:
+		return ClassOther
+	}
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = c.WriteTo(w)
+}
+
+// WriteTo writes the metrics to `w` in the Prometheus text format.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	// Don't hold the lock while writing, which could block for a while
+	// (e.g., if an HTTP client is slow):
+	n, err := io.WriteString(w, c.format())
+	return int64(n), err
+}
+
+// format returns the metrics in the Prometheus text format.
+func (c *Collector) format() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names := make([]string, 0, len(c.stages))
+	for name := range c.stages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+
+	b.WriteString("# HELP pipe_stage_runs_total Number of times that the stage was started.\n")
+	b.WriteString("# TYPE pipe_stage_runs_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "pipe_stage_runs_total{stage=%s} %d\n", quote(name), c.stages[name].runs)
+	}
+
+	b.WriteString("# HELP pipe_stage_failures_total Number of times that the stage failed, by failure class.\n")
+	b.WriteString("# TYPE pipe_stage_failures_total counter\n")
+	for _, name := range names {
+		m := c.stages[name]
+		classes := make([]string, 0, len(m.failures))
+		for class := range m.failures {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			fmt.Fprintf(
+				&b, "pipe_stage_failures_total{stage=%s,class=%s} %d\n",
+				quote(name), quote(class), m.failures[class],
+			)
+		}
+	}
+
+	b.WriteString("# HELP pipe_stage_duration_seconds How long the stage ran.\n")
+	b.WriteString("# TYPE pipe_stage_duration_seconds histogram\n")
+	for _, name := range names {
+		m := c.stages[name]
+		var cumulative uint64
+		for i, count := range m.durationBuckets {
+			cumulative += count
+			le := math.Inf(1)
+			if i < len(c.buckets) {
+				le = c.buckets[i]
+			}
+			fmt.Fprintf(
+				&b, "pipe_stage_duration_seconds_bucket{stage=%s,le=%s} %d\n",
+				quote(name), quote(formatFloat(le)), cumulative,
+			)
+		}
+		fmt.Fprintf(&b, "pipe_stage_duration_seconds_sum{stage=%s} %s\n", quote(name), formatFloat(m.durationSum))
+		fmt.Fprintf(&b, "pipe_stage_duration_seconds_count{stage=%s} %d\n", quote(name), m.durationCount)
+	}
+
+	b.WriteString("# HELP pipe_stage_bytes_in_total Number of bytes that the stage read from the previous stage.\n")
+	b.WriteString("# TYPE pipe_stage_bytes_in_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "pipe_stage_bytes_in_total{stage=%s} %d\n", quote(name), c.stages[name].bytesIn)
+	}
+
+	b.WriteString("# HELP pipe_stage_bytes_out_total Number of bytes that the stage passed to the next stage.\n")
+	b.WriteString("# TYPE pipe_stage_bytes_out_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "pipe_stage_bytes_out_total{stage=%s} %d\n", quote(name), c.stages[name].bytesOut)
+	}
+
+	return b.String()
+}
+
+// quote returns `s` as a quoted label value.
+func quote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// formatFloat formats `f` as a sample value or "le" label value.
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", f)
+}
@@ -0,0 +1,208 @@
+package metricspipe_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/go-pipe/pipe"
+	"github.com/github/go-pipe/pipe/metricspipe"
+)
+
+func TestCollector(t *testing.T) {
+	t.Parallel()
+
+	c := metricspipe.NewCollector(0.1, 1)
+	c.Observe(&pipe.PipelineStats{
+		Stages: []pipe.StageStats{
+			{Name: "git", Started: true, Duration: 50 * time.Millisecond, BytesOut: 100},
+			{
+				Name: "sort", Started: true, Duration: 500 * time.Millisecond,
+				Err: context.Canceled, BytesIn: 100, BytesOut: 80,
+			},
+			{Name: "never", Started: false},
+		},
+	})
+	c.Observe(&pipe.PipelineStats{
+		Stages: []pipe.StageStats{
+			{Name: "git", Started: true, Duration: 2 * time.Second, Err: errors.New("oops"), BytesOut: 10},
+		},
+	})
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", resp.Header.Get("Content-Type"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	expected := strings.Join([]string{
+		`# HELP pipe_stage_runs_total Number of times that the stage was started.`,
+		`# TYPE pipe_stage_runs_total counter`,
+		`pipe_stage_runs_total{stage="git"} 2`,
+		`pipe_stage_runs_total{stage="sort"} 1`,
+		`# HELP pipe_stage_failures_total Number of times that the stage failed, by failure class.`,
+		`# TYPE pipe_stage_failures_total counter`,
+		`pipe_stage_failures_total{stage="git",class="other"} 1`,
+		`pipe_stage_failures_total{stage="sort",class="context"} 1`,
+		`# HELP pipe_stage_duration_seconds How long the stage ran.`,
+		`# TYPE pipe_stage_duration_seconds histogram`,
+		`pipe_stage_duration_seconds_bucket{stage="git",le="0.1"} 1`,
+		`pipe_stage_duration_seconds_bucket{stage="git",le="1"} 1`,
+		`pipe_stage_duration_seconds_bucket{stage="git",le="+Inf"} 2`,
+		`pipe_stage_duration_seconds_sum{stage="git"} 2.05`,
+		`pipe_stage_duration_seconds_count{stage="git"} 2`,
+		`pipe_stage_duration_seconds_bucket{stage="sort",le="0.1"} 0`,
+		`pipe_stage_duration_seconds_bucket{stage="sort",le="1"} 1`,
+		`pipe_stage_duration_seconds_bucket{stage="sort",le="+Inf"} 1`,
+		`pipe_stage_duration_seconds_sum{stage="sort"} 0.5`,
+		`pipe_stage_duration_seconds_count{stage="sort"} 1`,
+		`# HELP pipe_stage_bytes_in_total Number of bytes that the stage read from the previous stage.`,
+		`# TYPE pipe_stage_bytes_in_total counter`,
+		`pipe_stage_bytes_in_total{stage="git"} 0`,
+		`pipe_stage_bytes_in_total{stage="sort"} 100`,
+		`# HELP pipe_stage_bytes_out_total Number of bytes that the stage passed to the next stage.`,
+		`# TYPE pipe_stage_bytes_out_total counter`,
+		`pipe_stage_bytes_out_total{stage="git"} 110`,
+		`pipe_stage_bytes_out_total{stage="sort"} 80`,
+		``,
+	}, "\n")
+	assert.Equal(t, expected, string(body))
+}
+
+// observingWriter is an `io.Writer` that records the stats of a
+// pipeline in a collector whenever it is written to.
+type observingWriter struct {
+	c *metricspipe.Collector
+}
+
+func (w observingWriter) Write(p []byte) (int, error) {
+	w.c.Observe(&pipe.PipelineStats{
+		Stages: []pipe.StageStats{{Name: "git", Started: true}},
+	})
+	return len(p), nil
+}
+
+func TestCollectorWriteToDoesNotBlockObserve(t *testing.T) {
+	t.Parallel()
+
+	// Writing the metrics mustn't keep pipelines from reporting their
+	// stats (which would deadlock here):
+	c := metricspipe.NewCollector()
+	_, err := c.WriteTo(observingWriter{c})
+	require.NoError(t, err)
+
+	var b strings.Builder
+	_, err = c.WriteTo(&b)
+	require.NoError(t, err)
+	assert.Contains(t, b.String(), `pipe_stage_runs_total{stage="git"} 1`+"\n")
+}
+
+func TestCollectorPipeline(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'sh' unavailable")
+	}
+
+	t.Parallel()
+	ctx := context.Background()
+
+	c := metricspipe.NewCollector()
+	for i := 0; i < 3; i++ {
+		p := pipe.New(c.Option(), pipe.WithIOInstrumentation())
+		p.Add(
+			pipe.Command("printf", "%d", fmt.Sprint(i)),
+			pipe.Command("sh", "-c", fmt.Sprintf("cat >/dev/null; exit %d", i)),
+		)
+		_ = p.Run(ctx)
+	}
+
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+
+	assert.Contains(t, body, `pipe_stage_runs_total{stage="printf"} 3`+"\n")
+	assert.Contains(t, body, `pipe_stage_runs_total{stage="sh"} 3`+"\n")
+	assert.Contains(t, body, `pipe_stage_failures_total{stage="sh",class="exit_code"} 2`+"\n")
+	assert.NotContains(t, body, `pipe_stage_failures_total{stage="printf"`)
+	assert.Contains(t, body, `pipe_stage_duration_seconds_count{stage="sh"} 3`+"\n")
+	assert.Contains(t, body, `pipe_stage_bytes_out_total{stage="printf"} 3`+"\n")
+	assert.Contains(t, body, `pipe_stage_bytes_in_total{stage="sh"} 3`+"\n")
+}
+
+func TestCollectorIgnoredErrors(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'sh' unavailable")
+	}
+
+	t.Parallel()
+	ctx := context.Background()
+
+	c := metricspipe.NewCollector()
+	p := pipe.New(c.Option())
+	p.Add(
+		pipe.IgnoreError(
+			pipe.Command("sh", "-c", "exit 3"),
+			func(error) bool { return true },
+		),
+		pipe.FilterError(
+			pipe.Command("sh", "-c", "kill -TERM $$"),
+			func(error) error { return errors.New("oops") },
+		),
+	)
+	require.Error(t, p.Run(ctx))
+
+	var b strings.Builder
+	_, err := c.WriteTo(&b)
+	require.NoError(t, err)
+	assert.Contains(t, b.String(), `pipe_stage_runs_total{stage="sh"} 2`+"\n")
+	assert.Contains(t, b.String(), `pipe_stage_failures_total{stage="sh",class="other"} 1`+"\n")
+	assert.NotContains(t, b.String(), `class="exit_code"`)
+	assert.NotContains(t, b.String(), `class="signal"`)
+}
+
+func TestClassify(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'sh' unavailable")
+	}
+
+	t.Parallel()
+
+	exitErr := func(script string) error {
+		err := exec.Command("sh", "-c", script).Run()
+		require.Error(t, err)
+		return err
+	}
+
+	for _, ex := range []struct {
+		err   error
+		class string
+	}{
+		{nil, ""},
+		{pipe.FinishEarly, ""},
+		{io.ErrClosedPipe, metricspipe.ClassPipe},
+		{exitErr("kill -PIPE $$"), metricspipe.ClassPipe},
+		{exitErr("kill -TERM $$"), metricspipe.ClassSignal},
+		{exitErr("exit 3"), metricspipe.ClassExitCode},
+		{fmt.Errorf("stage: %w", pipe.ErrMemoryLimitExceeded), metricspipe.ClassMemoryLimit},
+		{pipe.ErrOOMKilled, metricspipe.ClassMemoryLimit},
+		{context.DeadlineExceeded, metricspipe.ClassContext},
+		{errors.New("oops"), metricspipe.ClassOther},
+	} {
+		assert.Equal(t, ex.class, metricspipe.Classify(ex.err), "%v", ex.err)
+	}
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+// +build !windows
+
+package metricspipe_test
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/go-pipe/pipe"
+	"github.com/github/go-pipe/pipe/metricspipe"
+)
+
+func TestClassifySandboxed(t *testing.T) {
+	t.Parallel()
+
+	// The init process of a sandbox whose command was killed by
+	// SIGTERM exits with status 128+15:
+	var eErr *exec.ExitError
+	require.True(t, errors.As(exec.Command("sh", "-c", "exit 143").Run(), &eErr))
+
+	for _, ex := range []struct {
+		status syscall.WaitStatus
+		class  string
+	}{
+		{syscall.WaitStatus(syscall.SIGTERM), metricspipe.ClassSignal},
+		{syscall.WaitStatus(syscall.SIGPIPE), metricspipe.ClassPipe},
+		{syscall.WaitStatus(143 << 8), metricspipe.ClassExitCode},
+	} {
+		err := &pipe.SandboxExitError{ExitError: eErr, WaitStatus: ex.status}
+		assert.Equal(t, ex.class, metricspipe.Classify(err), "%v", err)
+	}
+}
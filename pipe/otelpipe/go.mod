@@ -0,0 +1,31 @@
+// otelpipe is a separate module, so that the main one doesn't depend
+// on OpenTelemetry. It needs a newer Go than the main module because
+// go.opentelemetry.io/otel v1.38.0 requires Go 1.23.
+//
+// The version of github.com/github/go-pipe that is required here must
+// include the `pipe.Tracer` interface. In this repository, go.work uses
+// the main module from ../.. instead.
+module github.com/github/go-pipe/pipe/otelpipe
+
+go 1.23.0
+
+require (
+	github.com/github/go-pipe v0.0.0-20261018164837-af99fd6c8690
+	github.com/stretchr/testify v1.11.1
+	go.opentelemetry.io/otel v1.38.0
+	go.opentelemetry.io/otel/sdk v1.38.0
+	go.opentelemetry.io/otel/trace v1.38.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/go-logr/logr v1.4.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	go.opentelemetry.io/auto/sdk v1.1.0 // indirect
+	go.opentelemetry.io/otel/metric v1.38.0 // indirect
+	golang.org/x/sync v0.7.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
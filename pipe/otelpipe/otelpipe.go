@@ -0,0 +1,108 @@
+// Package otelpipe traces `pipe.Pipeline`s using OpenTelemetry.
+//
+// It is a separate module, so that the `pipe` package doesn't depend
+// on OpenTelemetry.
+package otelpipe
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/github/go-pipe/pipe"
+)
+
+// WithTracer returns a `pipe.Option` that traces the pipeline using
+// `tracer`, as described for `Tracer()`, with the global propagator.
+func WithTracer(tracer trace.Tracer) pipe.Option {
+	return pipe.WithTracer(Tracer(tracer, nil))
+}
+
+// Tracer returns a `pipe.Tracer` that creates spans using `tracer`.
+// The trace context is propagated to external commands using
+// `propagator` or, if it is nil, the global propagator (see
+// `otel.GetTextMapPropagator()`). Each of the propagator's fields is
+// passed in an environment variable named after it, in upper case and
+// with dashes replaced by underscores; for example, W3C trace context
+// is passed in `TRACEPARENT` and `TRACESTATE`.
+//
+// Attributes that are durations are recorded as strings, like "1.5s".
+func Tracer(tracer trace.Tracer, propagator propagation.TextMapPropagator) pipe.Tracer {
+	return &otelTracer{
+		tracer:     tracer,
+		propagator: propagator,
+	}
+}
+
+type otelTracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+func (t *otelTracer) StartSpan(ctx context.Context, name string) (context.Context, pipe.Span) {
+	ctx, span := t.tracer.Start(ctx, name)
+	return ctx, otelSpan{span}
+}
+
+func (t *otelTracer) EnvVars(ctx context.Context) []pipe.EnvVar {
+	propagator := t.propagator
+	if propagator == nil {
+		propagator = otel.GetTextMapPropagator()
+	}
+
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+
+	vars := make([]pipe.EnvVar, 0, len(carrier))
+	for _, key := range carrier.Keys() {
+		vars = append(vars, pipe.EnvVar{
+			Key:   strings.ReplaceAll(strings.ToUpper(key), "-", "_"),
+			Value: carrier.Get(key),
+		})
+	}
+	return vars
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) SetAttribute(key string, value interface{}) {
+	s.span.SetAttributes(Attribute(key, value))
+}
+
+func (s otelSpan) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s otelSpan) End(end time.Time) {
+	s.span.End(trace.WithTimestamp(end))
+}
+
+// Attribute converts an attribute that is set by a pipeline (see
+// `pipe.Span.SetAttribute()`) to an OpenTelemetry attribute. Values of
+// unexpected types are formatted as strings.
+func Attribute(key string, value interface{}) attribute.KeyValue {
+	switch v := value.(type) {
+	case string:
+		return attribute.String(key, v)
+	case int:
+		return attribute.Int(key, v)
+	case int64:
+		return attribute.Int64(key, v)
+	case []string:
+		return attribute.StringSlice(key, v)
+	case time.Duration:
+		return attribute.String(key, v.String())
+	default:
+		return attribute.String(key, fmt.Sprint(v))
+	}
+}
@@ -0,0 +1,106 @@
+package otelpipe_test
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/github/go-pipe/pipe"
+	"github.com/github/go-pipe/pipe/otelpipe"
+)
+
+func TestTracer(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'sh' unavailable")
+	}
+
+	t.Parallel()
+	ctx := context.Background()
+
+	rec := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	tracer := otelpipe.Tracer(provider.Tracer("test"), propagation.TraceContext{})
+
+	p := pipe.New(pipe.WithID("traced"), pipe.WithTracer(tracer))
+	p.Add(
+		pipe.Command("sh", "-c", `echo "$TRACEPARENT"`),
+		pipe.Command("sh", "-c", `cat; exit 5`),
+	)
+	out, err := p.Output(ctx)
+	require.Error(t, err)
+
+	spans := rec.Ended()
+	require.Len(t, spans, 3)
+	byName := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range spans {
+		if s.Name() == "pipeline" {
+			byName["pipeline"] = s
+			continue
+		}
+		byName[fmt.Sprint(attrs(s)["stage_index"].AsInt64())] = s
+	}
+
+	ps := byName["pipeline"]
+	require.NotNil(t, ps)
+	assert.Equal(t, "traced", attrs(ps)["pipeline_id"].AsString())
+	assert.EqualValues(t, 2, attrs(ps)["stages"].AsInt64())
+	assert.Equal(t, codes.Error, ps.Status().Code)
+
+	first, last := byName["0"], byName["1"]
+	require.NotNil(t, first)
+	require.NotNil(t, last)
+	for _, s := range []sdktrace.ReadOnlySpan{first, last} {
+		assert.Equal(t, "sh", s.Name())
+		assert.Equal(t, ps.SpanContext().SpanID(), s.Parent().SpanID())
+		assert.Positive(t, attrs(s)["pid"].AsInt64())
+	}
+
+	// The first command got its own span's trace context:
+	sc := first.SpanContext()
+	assert.Equal(t, fmt.Sprintf("00-%s-%s-01\n", sc.TraceID(), sc.SpanID()), string(out))
+	assert.Equal(t,
+		[]string{"sh", "-c", `echo "$TRACEPARENT"`}, attrs(first)["argv"].AsStringSlice(),
+	)
+	assert.EqualValues(t, 0, attrs(first)["exit_code"].AsInt64())
+	assert.Equal(t, codes.Unset, first.Status().Code)
+
+	assert.EqualValues(t, 5, attrs(last)["exit_code"].AsInt64())
+	assert.Equal(t, codes.Error, last.Status().Code)
+}
+
+func TestAttribute(t *testing.T) {
+	t.Parallel()
+
+	for _, ex := range []struct {
+		value    interface{}
+		expected attribute.KeyValue
+	}{
+		{"abc", attribute.String("k", "abc")},
+		{42, attribute.Int("k", 42)},
+		{int64(42), attribute.Int64("k", 42)},
+		{[]string{"a", "b"}, attribute.StringSlice("k", []string{"a", "b"})},
+		{1500 * time.Millisecond, attribute.String("k", "1.5s")},
+		{true, attribute.String("k", "true")},
+	} {
+		assert.Equal(t, ex.expected, otelpipe.Attribute("k", ex.value), ex.value)
+	}
+}
+
+// attrs returns the attributes of `s` by key.
+func attrs(s sdktrace.ReadOnlySpan) map[string]attribute.Value {
+	m := make(map[string]attribute.Value)
+	for _, kv := range s.Attributes() {
+		m[string(kv.Key)] = kv.Value
+	}
+	return m
+}
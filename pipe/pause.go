@@ -0,0 +1,157 @@
+package pipe
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// pauseGate blocks the I/O of function stages while a pipeline is
+// paused.
+type pauseGate struct {
+	// paused is read without holding `mu`, as a fast path.
+	paused atomic.Bool
+
+	mu sync.Mutex
+	// resumed is closed when the pipeline is resumed. It is replaced
+	// each time the pipeline is paused.
+	resumed chan struct{}
+}
+
+// pause closes the gate. It returns false if it was already closed.
+func (g *pauseGate) pause() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.paused.Load() {
+		return false
+	}
+	g.resumed = make(chan struct{})
+	g.paused.Store(true)
+	return true
+}
+
+// resume opens the gate. It returns false if it was already open.
+func (g *pauseGate) resume() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.paused.Load() {
+		return false
+	}
+	g.paused.Store(false)
+	close(g.resumed)
+	return true
+}
+
+// wait blocks while the gate is closed, or until `ctx` is done.
+func (g *pauseGate) wait(ctx context.Context) error {
+	if !g.paused.Load() {
+		return nil
+	}
+
+	g.mu.Lock()
+	resumed := g.resumed
+	paused := g.paused.Load()
+	g.mu.Unlock()
+
+	if !paused {
+		return nil
+	}
+
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// gatedReader is an `io.Reader` whose reads block while `gate` is
+// closed.
+type gatedReader struct {
+	ctx  context.Context
+	gate *pauseGate
+	r    io.Reader
+}
+
+func (r gatedReader) Read(p []byte) (int, error) {
+	if err := r.gate.wait(r.ctx); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// gatedWriter is an `io.Writer` whose writes block while `gate` is
+// closed.
+type gatedWriter struct {
+	ctx  context.Context
+	gate *pauseGate
+	w    io.Writer
+}
+
+func (w gatedWriter) Write(p []byte) (int, error) {
+	if err := w.gate.wait(w.ctx); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// WithPausable allows the pipeline to be paused with `Pause()`. It
+// makes function stages read and write through a gate that blocks
+// while the pipeline is paused, which hides the concrete types of their
+// stdin and stdout (e.g., `*os.File`) and the optional interfaces that
+// they implement (e.g., `io.WriterTo`), so it should only be used if
+// the pipeline is actually going to be paused.
+func WithPausable() Option {
+	return func(p *Pipeline) {
+		p.pausable = true
+	}
+}
+
+// Pause suspends the pipeline: every command stage's process group is
+// sent SIGSTOP, and function stages block at their next read or write.
+// The pipeline can be continued with `Resume()`. It returns the first
+// error encountered signaling a stage. Pausing a paused pipeline does
+// nothing. The pipeline must have been created with `WithPausable()`.
+//
+// If the pipeline's context expires while it is paused, function
+// stages stop blocking, and command stages are continued so that
+// they can be terminated as usual.
+//
+// Pausing command stages is not supported on Windows.
+func (p *Pipeline) Pause() error {
+	if !p.hasStarted() {
+		panic("attempt to pause a pipeline that has not started")
+	}
+	if !p.pausable {
+		panic("attempt to pause a pipeline that is not pausable")
+	}
+
+	if !p.gate.pause() {
+		return nil
+	}
+	return p.signalStages(stopSignal)
+}
+
+// Resume continues a pipeline that was suspended by `Pause()`.
+// Resuming a pipeline that isn't paused does nothing.
+func (p *Pipeline) Resume() error {
+	if !p.hasStarted() {
+		panic("attempt to resume a pipeline that has not started")
+	}
+	if !p.pausable {
+		panic("attempt to resume a pipeline that is not pausable")
+	}
+
+	if !p.gate.resume() {
+		return nil
+	}
+	return p.signalStages(continueSignal)
+}
+
+// Paused returns true if the pipeline is currently paused.
+func (p *Pipeline) Paused() bool {
+	return p.gate.paused.Load()
+}
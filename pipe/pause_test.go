@@ -0,0 +1,126 @@
+//go:build !windows
+// +build !windows
+
+package pipe_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/go-pipe/pipe"
+)
+
+// assertStalled checks that `progress()` doesn't change over a short
+// period of time, and returns its value.
+func assertStalled(t *testing.T, progress func() int64) int64 {
+	t.Helper()
+
+	// Give the stages a moment to notice the pause:
+	time.Sleep(50 * time.Millisecond)
+	before := progress()
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, before, progress())
+	return before
+}
+
+func TestPipelinePauseFunction(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var written atomic.Int64
+	p := pipe.New(pipe.WithPausable())
+	p.Add(
+		pipe.Function(
+			"producer",
+			func(ctx context.Context, _ pipe.Env, _ io.Reader, stdout io.Writer) error {
+				for {
+					if _, err := stdout.Write([]byte("x\n")); err != nil {
+						return err
+					}
+					written.Add(1)
+					time.Sleep(time.Millisecond)
+				}
+			},
+		),
+		pipe.Function(
+			"consumer",
+			func(_ context.Context, _ pipe.Env, stdin io.Reader, _ io.Writer) error {
+				_, err := io.Copy(io.Discard, stdin)
+				return err
+			},
+		),
+	)
+	require.NoError(t, p.Start(ctx))
+
+	assert.False(t, p.Paused())
+	require.NoError(t, p.Pause())
+	assert.True(t, p.Paused())
+	before := assertStalled(t, written.Load)
+
+	require.NoError(t, p.Resume())
+	assert.False(t, p.Paused())
+	assert.Eventually(t, func() bool { return written.Load() > before }, time.Second, 10*time.Millisecond)
+
+	// Cancelling a paused pipeline must unblock its stages:
+	require.NoError(t, p.Pause())
+	cancel()
+	assert.ErrorIs(t, p.Wait(), context.Canceled)
+}
+
+func TestPipelinePauseCommand(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	counter := filepath.Join(t.TempDir(), "counter")
+	progress := func() int64 {
+		data, _ := os.ReadFile(counter)
+		n, _ := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		return n
+	}
+
+	p := pipe.New(pipe.WithPausable())
+	p.Add(pipe.Command(
+		"sh", "-c", `i=0; while :; do i=$((i+1)); echo $i >"$0.tmp"; mv "$0.tmp" "$0"; done`, counter,
+	))
+	require.NoError(t, p.Start(ctx))
+	require.Eventually(t, func() bool { return progress() > 0 }, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, p.Pause())
+	before := assertStalled(t, progress)
+
+	require.NoError(t, p.Resume())
+	assert.Eventually(t, func() bool { return progress() > before }, time.Second, 10*time.Millisecond)
+
+	// A paused command must still be killable:
+	require.NoError(t, p.Pause())
+	cancel()
+	assert.ErrorIs(t, p.Wait(), context.Canceled)
+}
+
+func TestPipelinePauseRequiresPausable(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	p := pipe.New()
+	p.Add(pipe.Function("noop", func(context.Context, pipe.Env, io.Reader, io.Writer) error {
+		return nil
+	}))
+	require.NoError(t, p.Start(ctx))
+	assert.Panics(t, func() { _ = p.Pause() })
+	assert.False(t, p.Paused())
+	require.NoError(t, p.Wait())
+}
@@ -6,7 +6,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // Env represents the environment that a pipeline stage should run in.
@@ -20,6 +23,64 @@ type Env struct {
 	// environment variables that would be inherited from the current
 	// process.
 	Vars []AppendVars
+
+	// TempDir is the pipeline's scratch directory, if one was
+	// requested using `WithTempDir()`. It is removed when the
+	// pipeline is done.
+	TempDir string
+
+	// PipelineID is the ID of the pipeline that the stage is part of.
+	// See `WithID()`.
+	PipelineID string
+
+	// StageIndex is the index of the stage within the pipeline
+	// (starting at 0).
+	StageIndex int
+
+	// idEnvVar and stageIndexEnvVar are the names of the environment
+	// variables in which external commands get `PipelineID` and
+	// `StageIndex`, if any.
+	idEnvVar         string
+	stageIndexEnvVar string
+
+	// cgroup is the cgroup that command stages should be run in by
+	// default, if any.
+	cgroup *cgroup
+
+	// sched are the default scheduling attributes for command stages.
+	sched schedAttrs
+
+	// gate, if set, is used by function stages to block while the
+	// pipeline is paused.
+	gate *pauseGate
+
+	// commandPolicy, if set, must allow each command before it is
+	// started.
+	commandPolicy CommandPolicy
+
+	// eventHandler is the pipeline's event handler, for stages that
+	// report events of their own.
+	eventHandler func(e *Event)
+
+	// auditSink, if set, receives audit records for every command
+	// that is started.
+	auditSink AuditSink
+
+	// redactor, if set, masks secrets in data that the pipeline
+	// surfaces.
+	redactor *Redactor
+
+	// envFilter determines which environment variables command
+	// stages get.
+	envFilter envFilter
+
+	// varSources describe the options that added the corresponding
+	// entries of `Vars`, for `EnvTrace`s.
+	varSources []string
+
+	// envTrace, if set, is called with the trace of each command
+	// stage's environment.
+	envTrace func(stage string, trace EnvTrace)
 }
 
 // FinishEarly is an error that can be returned by a `Stage` to
@@ -65,6 +126,79 @@ type Pipeline struct {
 
 	eventHandler func(e *Event)
 	panicHandler StagePanicHandler
+
+	// lifecycleEvents is set if lifecycle events should be passed to
+	// `eventHandler`.
+	lifecycleEvents bool
+
+	// identified is set if the pipeline's ID was set explicitly, in
+	// which case it is included in error messages.
+	identified bool
+
+	memoryBudget *memoryBudget
+
+	cgroupOptions *CgroupOptions
+
+	// If `useTempDir` is set, a temporary directory is created (using
+	// `tempDirPattern`) when the pipeline is started.
+	useTempDir     bool
+	tempDirPattern string
+
+	// If `pausable` is set, function stages' I/O passes through
+	// `gate`, which blocks it while the pipeline is paused.
+	pausable bool
+	gate     pauseGate
+
+	signalForwarder *signalForwarder
+
+	// stdinStopper, if set, wraps `stdin` so that `Stop()` can end
+	// the pipeline's input.
+	stdinStopper *stoppableReader
+
+	// waitOnce ensures that the stages are only waited for once, even
+	// if both `Wait()` and `Stop()` are called. `waitErr` is the
+	// result.
+	waitOnce sync.Once
+	waitErr  error
+
+	// abortCause holds the error passed to `Abort()` (wrapped in an
+	// `abortCause`), if it has been called.
+	abortCause atomic.Value
+
+	// startTime is when the pipeline was started.
+	startTime time.Time
+
+	// tracer, if set, traces the pipeline's execution. `trace` holds
+	// the spans while the pipeline is running.
+	tracer Tracer
+	trace  *pipelineTrace
+
+	// timelineRecorder, if set, records the pipeline's timeline.
+	timelineRecorder *TimelineRecorder
+
+	// statsHandlers are called with the pipeline's stats when it is
+	// done. `stats` collects them while the pipeline is running.
+	statsHandlers []func(stats *PipelineStats)
+	stats         *statsRun
+
+	// observers are called with each event (after redaction), for
+	// features that are based on the pipeline's events. `finishers`
+	// are called when the pipeline is done.
+	observers []func(e *Event)
+	finishers []func(err error)
+
+	// If `instrumentIO` is set, the data that is passed from each
+	// stage to the next passes through one of the `taps` (indexed by
+	// the stage that generated it).
+	instrumentIO bool
+	taps         []*streamTap
+}
+
+// abortCause wraps the error passed to `Pipeline.Abort()`, so that
+// it can be stored in an `atomic.Value` regardless of its concrete
+// type.
+type abortCause struct {
+	err error
 }
 
 var emptyEventHandler = func(e *Event) {}
@@ -83,6 +217,10 @@ type NewPipeFn func(opts ...Option) *Pipeline
 // applied.
 func New(options ...Option) *Pipeline {
 	p := &Pipeline{
+		env: Env{
+			idEnvVar:         DefaultIDEnvVar,
+			stageIndexEnvVar: DefaultStageIndexEnvVar,
+		},
 		eventHandler: emptyEventHandler,
 	}
 
@@ -90,6 +228,10 @@ func New(options ...Option) *Pipeline {
 		option(p)
 	}
 
+	if p.env.PipelineID == "" {
+		p.env.PipelineID = newPipelineID()
+	}
+
 	return p
 }
 
@@ -128,7 +270,7 @@ func WithStdoutCloser(stdout io.WriteCloser) Option {
 // WithEnvVar appends an environment variable for the pipeline.
 func WithEnvVar(key, value string) Option {
 	return func(p *Pipeline) {
-		p.env.Vars = append(p.env.Vars, func(_ context.Context, vars []EnvVar) []EnvVar {
+		p.env.addVars(fmt.Sprintf("WithEnvVar(%q)", key), func(_ context.Context, vars []EnvVar) []EnvVar {
 			return append(vars, EnvVar{Key: key, Value: value})
 		})
 	}
@@ -137,7 +279,7 @@ func WithEnvVar(key, value string) Option {
 // WithEnvVars appends several environment variable for the pipeline.
 func WithEnvVars(b []EnvVar) Option {
 	return func(p *Pipeline) {
-		p.env.Vars = append(p.env.Vars, func(_ context.Context, a []EnvVar) []EnvVar {
+		p.env.addVars("WithEnvVars", func(_ context.Context, a []EnvVar) []EnvVar {
 			return append(a, b...)
 		})
 	}
@@ -146,7 +288,7 @@ func WithEnvVars(b []EnvVar) Option {
 // WithEnvVarFunc appends a context-based environment variable for the pipeline.
 func WithEnvVarFunc(key string, valueFunc ContextValueFunc) Option {
 	return func(p *Pipeline) {
-		p.env.Vars = append(p.env.Vars, func(ctx context.Context, vars []EnvVar) []EnvVar {
+		p.env.addVars(fmt.Sprintf("WithEnvVarFunc(%q)", key), func(ctx context.Context, vars []EnvVar) []EnvVar {
 			if val, ok := valueFunc(ctx); ok {
 				return append(vars, EnvVar{Key: key, Value: val})
 			}
@@ -158,7 +300,7 @@ func WithEnvVarFunc(key string, valueFunc ContextValueFunc) Option {
 // WithEnvVarsFunc appends several context-based environment variables for the pipeline.
 func WithEnvVarsFunc(valuesFunc ContextValuesFunc) Option {
 	return func(p *Pipeline) {
-		p.env.Vars = append(p.env.Vars, func(ctx context.Context, vars []EnvVar) []EnvVar {
+		p.env.addVars("WithEnvVarsFunc", func(ctx context.Context, vars []EnvVar) []EnvVar {
 			return append(vars, valuesFunc(ctx)...)
 		})
 	}
@@ -170,16 +312,41 @@ type Event struct {
 	Msg     string
 	Err     error
 	Context map[string]interface{}
+
+	// PipelineID is the ID of the pipeline that emitted the event. If
+	// the event concerns a particular stage, its index is included in
+	// `Context` as "stage_index". Both are also set for the events that
+	// stages created by `MemoryLimit()` and similar functions pass to
+	// the handlers that they were created with, once they have been
+	// started (but see `SampleResources()`).
+	PipelineID string
+
+	// Kind is the kind of lifecycle event, or empty for other events.
+	Kind EventKind
+
+	// Time is when the event happened.
+	Time time.Time
 }
 
 // WithEventHandler sets a handler for the pipeline. Setting one will emit
-// and event for each process.
+// and event for each process. Lifecycle events (those with a `Kind`)
+// are only passed to it if the pipeline is also created
+// `WithLifecycleEvents()`.
 func WithEventHandler(handler func(e *Event)) Option {
 	return func(p *Pipeline) {
 		p.eventHandler = handler
 	}
 }
 
+// WithLifecycleEvents arranges for the pipeline's event handler to
+// also receive lifecycle events, i.e., events with a `Kind`, like
+// `StageStarted` and `PipelineFinished`.
+func WithLifecycleEvents() Option {
+	return func(p *Pipeline) {
+		p.lifecycleEvents = true
+	}
+}
+
 // WithStagePanicHandler sets a panic handler for the stages within a pipeline.
 // When a pipeline stage panics, the provided handler will be invoked, allowing
 // the client to handle the panic in whatever way they see fit.
@@ -228,7 +395,46 @@ func (p *Pipeline) Start(ctx context.Context) error {
 	}
 
 	atomic.StoreUint32(&p.started, 1)
+	p.startTime = time.Now()
 	ctx, p.cancel = context.WithCancel(ctx)
+	ctx = p.startTrace(ctx)
+	p.startTimeline()
+	p.startStats()
+
+	p.eventHandler = p.identifyingEventHandler(
+		p.env.redactor.redactEventHandler(
+			p.observingEventHandler(p.lifecycleEventHandler(p.eventHandler)),
+		),
+		-1,
+	)
+
+	if p.cgroupOptions != nil {
+		cg, err := newCgroup(*p.cgroupOptions)
+		if err != nil {
+			p.cancel()
+			err = p.env.redactor.redactError(
+				fmt.Errorf("creating cgroup for %s: %w", p.describe(), err),
+			)
+			p.finish(err)
+			return err
+		}
+		p.env.cgroup = cg
+	}
+
+	if err := p.createTempDir(); err != nil {
+		p.cancel()
+		if p.env.cgroup != nil {
+			_ = p.env.cgroup.remove()
+		}
+		err = p.env.redactor.redactError(err)
+		p.finish(err)
+		return err
+	}
+
+	if p.pausable {
+		p.env.gate = &p.gate
+	}
+	p.env.eventHandler = p.eventHandler
 
 	var nextStdin io.ReadCloser
 	if p.stdin != nil {
@@ -276,7 +482,19 @@ func (p *Pipeline) Start(ctx context.Context) error {
 		// own `nopCloser`, which behaves like `io.NopCloser`, except
 		// that `pipe.CommandStage` knows how to unwrap it before
 		// passing it to `exec.Cmd`.
-		nextStdin = newNopCloser(p.stdin)
+		stdin := p.stdin
+		var first Stage
+		if len(p.stages) != 0 {
+			first = p.stages[0]
+		}
+		if p.stdinStopper = stoppableStdin(stdin, first); p.stdinStopper != nil {
+			stdin = p.stdinStopper
+		}
+		nextStdin = newNopCloser(stdin)
+	}
+
+	if p.instrumentIO {
+		p.taps = make([]*streamTap, len(p.stages))
 	}
 
 	for i, s := range p.stages {
@@ -284,8 +502,12 @@ func (p *Pipeline) Start(ctx context.Context) error {
 			phs.SetPanicHandler(p.panicHandler)
 		}
 
+		env := p.env
+		env.StageIndex = i
+		env.eventHandler = p.identifyingEventHandler(p.eventHandler, i)
+
 		var err error
-		stdout, err := s.Start(ctx, p.env, nextStdin)
+		stdout, err := s.Start(p.startStageTrace(ctx, i, s), env, nextStdin)
 		if err != nil {
 			// Close the pipe that the previous stage was writing to.
 			// That should cause it to exit even if it's not minding
@@ -300,16 +522,33 @@ func (p *Pipeline) Start(ctx context.Context) error {
 			for _, s := range p.stages[:i] {
 				_ = s.Wait()
 			}
+			p.waitTaps()
+			if p.env.cgroup != nil {
+				_ = p.env.cgroup.remove()
+			}
+			p.removeTempDir()
 			p.eventHandler(&Event{
 				Command: s.Name(),
 				Msg:     "failed to start pipeline stage",
 				Err:     err,
+				Context: map[string]interface{}{
+					"stage_index": i,
+				},
 			})
-			return fmt.Errorf("starting pipeline stage %q: %w", s.Name(), err)
+			p.recordStartError(i, p.env.redactor.redactError(err))
+			stageErr := p.stageError(i, s.Name(), err)
+			stageErr.Starting = true
+			err = p.env.redactor.redactError(stageErr)
+			p.finish(err)
+			return err
 		}
-		nextStdin = stdout
+		nextStdin = p.tapOutput(i, stdout)
 	}
 
+	// The synthetic stage below isn't counted in the "pipeline started"
+	// event:
+	numStages := len(p.stages)
+
 	// If the pipeline was configured with a `stdout`, add a synthetic
 	// stage to copy the last stage's stdout to that writer:
 	if p.stdout != nil {
@@ -319,6 +558,23 @@ func (p *Pipeline) Start(ctx context.Context) error {
 		_, _ = c.Start(ctx, p.env, nextStdin)
 	}
 
+	if p.memoryBudget != nil {
+		p.memoryBudget.start(ctx, p.stages, p.eventHandler)
+	}
+
+	if p.signalForwarder != nil {
+		p.signalForwarder.start(p)
+	}
+
+	p.eventHandler(&Event{
+		Command: "pipeline",
+		Msg:     "pipeline started",
+		Context: map[string]interface{}{
+			"stages": numStages,
+		},
+		Kind: PipelineStarted,
+	})
+
 	return nil
 }
 
@@ -329,22 +585,67 @@ func (p *Pipeline) Output(ctx context.Context) ([]byte, error) {
 	return buf.Bytes(), err
 }
 
-// Wait waits for each stage in the pipeline to exit.
+// Wait waits for each stage in the pipeline to exit. If it is called
+// more than once (or concurrently with `Stop()`), every call returns
+// the same result.
 func (p *Pipeline) Wait() error {
 	if !p.hasStarted() {
 		panic("unable to wait on a pipeline that has not started")
 	}
 
+	p.waitOnce.Do(func() {
+		p.waitErr = p.env.redactor.redactError(p.wait())
+		p.finish(p.waitErr)
+		p.eventHandler(&Event{
+			Command: "pipeline",
+			Msg:     "pipeline finished",
+			Err:     p.waitErr,
+			Context: map[string]interface{}{
+				"duration": time.Since(p.startTime),
+			},
+			Kind: PipelineFinished,
+		})
+	})
+	return p.waitErr
+}
+
+func (p *Pipeline) wait() error {
 	// Make sure that all of the cleanup eventually happens:
 	defer p.cancel()
 
+	if p.memoryBudget != nil {
+		defer p.memoryBudget.stop()
+	}
+
+	if p.signalForwarder != nil {
+		defer p.signalForwarder.stop()
+	}
+
+	defer p.removeTempDir()
+
+	if p.env.cgroup != nil {
+		defer func() {
+			if err := p.env.cgroup.remove(); err != nil {
+				p.eventHandler(&Event{
+					Command: "pipeline",
+					Msg:     "failed to remove cgroup",
+					Err:     err,
+				})
+			}
+		}()
+	}
+
 	var earliestStageErr error
 	var earliestFailedStage Stage
+	var earliestFailedIndex int
 
 	finishedEarly := false
 	for i := len(p.stages) - 1; i >= 0; i-- {
 		s := p.stages[i]
 		err := s.Wait()
+		if p.stats != nil {
+			p.stats.waited(i, err)
+		}
 
 		// Handle errors:
 		switch {
@@ -391,7 +692,7 @@ func (p *Pipeline) Wait() error {
 				// In this case, the pipe error from this stage is the
 				// most important error that we have seen so far, so
 				// remember it:
-				earliestFailedStage, earliestStageErr = s, err
+				earliestFailedStage, earliestFailedIndex, earliestStageErr = s, i, err
 			}
 
 		default:
@@ -402,23 +703,91 @@ func (p *Pipeline) Wait() error {
 			// iterating through stages in reverse order, overwrite
 			// any existing remembered errors (which would have come
 			// from a later stage):
-			earliestFailedStage, earliestStageErr = s, err
+			earliestFailedStage, earliestFailedIndex, earliestStageErr = s, i, err
 			finishedEarly = false
 		}
 	}
 
+	p.waitTaps()
+
 	if earliestStageErr != nil {
+		// If the pipeline was aborted and the stage failed because
+		// it was canceled (or killed) as a consequence, report the
+		// cause instead:
+		cause, aborted := p.abortCause.Load().(abortCause)
+		if aborted && errors.Is(earliestStageErr, context.Canceled) {
+			earliestStageErr = cause.err
+		}
+
 		p.eventHandler(&Event{
 			Command: earliestFailedStage.Name(),
 			Msg:     "command failed",
 			Err:     earliestStageErr,
+			Context: map[string]interface{}{
+				"stage_index": earliestFailedIndex,
+			},
 		})
-		return fmt.Errorf("%s: %w", earliestFailedStage.Name(), earliestStageErr)
+		return p.stageError(earliestFailedIndex, earliestFailedStage.Name(), earliestStageErr)
 	}
 
 	return nil
 }
 
+// Signal sends `sig` to every running command stage in the pipeline
+// (to its whole process group, on platforms that support process
+// groups). Stages that have already exited are skipped. It returns the
+// first error encountered.
+func (p *Pipeline) Signal(sig os.Signal) error {
+	if !p.hasStarted() {
+		panic("attempt to signal a pipeline that has not started")
+	}
+
+	return p.signalStages(sig)
+}
+
+// Abort cancels the pipeline, as if the context passed to `Start()`
+// had been canceled, except that if a stage fails as a result, the
+// error returned by `Wait()` wraps `cause` (instead of, e.g.,
+// `context.Canceled`).
+// This allows callers to distinguish different reasons for stopping a
+// pipeline. Only the first call to `Abort()` has an effect. If `cause`
+// is nil, `context.Canceled` is used.
+func (p *Pipeline) Abort(cause error) {
+	if !p.hasStarted() {
+		panic("attempt to abort a pipeline that has not started")
+	}
+
+	if cause == nil {
+		cause = context.Canceled
+	}
+	p.abortCause.CompareAndSwap(nil, abortCause{err: cause})
+	p.cancel()
+}
+
+// signalStages sends `sig` to every stage in the pipeline that
+// implements `SignalableStage`. Stages that have already exited are
+// skipped. It returns the first error encountered.
+func (p *Pipeline) signalStages(sig os.Signal) error {
+	var firstErr error
+	for _, s := range p.stages {
+		ss, ok := asSignalableStage(s)
+		if !ok {
+			continue
+		}
+
+		var err error
+		if sig == nil {
+			err = fmt.Errorf("signaling stage %q: not supported on this platform", s.Name())
+		} else {
+			err = ss.Signal(sig)
+		}
+		if err != nil && !errors.Is(err, os.ErrProcessDone) && firstErr == nil {
+			firstErr = fmt.Errorf("signaling stage %q: %w", s.Name(), err)
+		}
+	}
+	return firstErr
+}
+
 // Run starts and waits for the commands in the pipeline.
 func (p *Pipeline) Run(ctx context.Context) error {
 	if err := p.Start(ctx); err != nil {
@@ -0,0 +1,182 @@
+package pipe
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// DefaultIDEnvVar is the name of the environment variable in which
+// external commands get the ID of their pipeline, unless it is changed
+// using `WithIDEnvVar()`.
+const DefaultIDEnvVar = "GO_PIPE_ID"
+
+// DefaultStageIndexEnvVar is the name of the environment variable in
+// which external commands get their index within the pipeline
+// (starting at 0), unless it is changed using
+// `WithStageIndexEnvVar()`.
+const DefaultStageIndexEnvVar = "GO_PIPE_STAGE_INDEX"
+
+// WithID sets the pipeline's ID, which is used to correlate its
+// commands, events and errors. By default, a random ID is generated.
+// Errors returned by the pipeline only mention the ID if it was set
+// using this option or `WithIDEnvVar()`, so that callers who don't use
+// IDs get the same error messages as before.
+func WithID(id string) Option {
+	return func(p *Pipeline) {
+		p.env.PipelineID = id
+		p.identified = true
+	}
+}
+
+// WithIDEnvVar changes the name of the environment variable in which
+// external commands get the pipeline's ID from `DefaultIDEnvVar` to
+// `name`. If `name` is empty, the ID isn't passed to them.
+func WithIDEnvVar(name string) Option {
+	return func(p *Pipeline) {
+		p.env.idEnvVar = name
+		p.identified = true
+	}
+}
+
+// WithStageIndexEnvVar changes the name of the environment variable in
+// which external commands get their index within the pipeline from
+// `DefaultStageIndexEnvVar` to `name`. If `name` is empty, the index
+// isn't passed to them.
+func WithStageIndexEnvVar(name string) Option {
+	return func(p *Pipeline) {
+		p.env.stageIndexEnvVar = name
+	}
+}
+
+// ID returns the pipeline's ID.
+func (p *Pipeline) ID() string {
+	return p.env.PipelineID
+}
+
+// newPipelineID returns a random pipeline ID.
+func newPipelineID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// This never happens on the platforms that we support.
+		panic(fmt.Sprintf("generating pipeline ID: %v", err))
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// StageError is the error returned by `Pipeline.Start()` when one of
+// its stages fails to start, and by `Pipeline.Wait()` when one of its
+// stages fails. It identifies the pipeline and the stage, which can be
+// retrieved using `errors.As()`.
+type StageError struct {
+	// PipelineID is the ID of the pipeline.
+	PipelineID string
+
+	// Stage is the name of the stage that failed, and StageIndex its
+	// position within the pipeline (starting at 0).
+	Stage      string
+	StageIndex int
+
+	// Err is the error that the stage failed with.
+	Err error
+
+	// Starting is true if the stage failed to start.
+	Starting bool
+
+	// identified is set if the message should include the pipeline's
+	// ID and the stage's index (see `WithID()`).
+	identified bool
+}
+
+func (e *StageError) Error() string {
+	msg := fmt.Sprintf("%s: %v", e.Stage, e.Err)
+	if e.Starting {
+		msg = fmt.Sprintf("starting pipeline stage %q: %v", e.Stage, e.Err)
+	}
+	if !e.identified {
+		return msg
+	}
+	return fmt.Sprintf("pipeline %s, stage %d: %s", e.PipelineID, e.StageIndex, msg)
+}
+
+// stageError returns a `StageError` for stage `i`, named `name`, which
+// failed with `err`.
+func (p *Pipeline) stageError(i int, name string, err error) *StageError {
+	return &StageError{
+		PipelineID: p.env.PipelineID,
+		Stage:      name,
+		StageIndex: i,
+		Err:        err,
+		identified: p.identified,
+	}
+}
+
+// describe returns "pipeline", followed by the pipeline's ID if it was
+// set explicitly, for use in error messages.
+func (p *Pipeline) describe() string {
+	if !p.identified {
+		return "pipeline"
+	}
+	return "pipeline " + p.env.PipelineID
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// identifyingEventHandler returns an event handler that sets the
+// pipeline ID and time of events (unless they are already set) before
+// passing them to `handler`. If `stageIndex` is not negative, it is also
+// added to the events' context as "stage_index".
+func (p *Pipeline) identifyingEventHandler(handler func(e *Event), stageIndex int) func(e *Event) {
+	return func(e *Event) {
+		identifyEvent(e, p.env.PipelineID, stageIndex)
+		handler(e)
+	}
+}
+
+// identifyEvent sets the pipeline ID and time of `e`, as described for
+// `identifyingEventHandler()`.
+func identifyEvent(e *Event, pipelineID string, stageIndex int) {
+	if e.PipelineID == "" {
+		e.PipelineID = pipelineID
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if stageIndex >= 0 {
+		if _, ok := e.Context["stage_index"]; !ok {
+			if e.Context == nil {
+				e.Context = make(map[string]interface{})
+			}
+			e.Context["stage_index"] = stageIndex
+		}
+	}
+}
+
+// stageEvents identifies the events that a stage created by a function
+// like `MemoryLimit()` passes to the event handler that the function
+// was called with, which doesn't go through the pipeline. The pipeline
+// ID and stage index are set when the stage is started.
+type stageEvents struct {
+	handler    func(e *Event)
+	pipelineID string
+	stageIndex int
+}
+
+func newStageEvents(handler func(e *Event)) *stageEvents {
+	return &stageEvents{handler: handler, stageIndex: -1}
+}
+
+func (s *stageEvents) handle(e *Event) {
+	identifyEvent(e, s.pipelineID, s.stageIndex)
+	s.handler(e)
+}
+
+// start records the pipeline ID and stage index from `env`. It must be
+// called before any events are emitted in the background.
+func (s *stageEvents) start(env Env) {
+	s.pipelineID = env.PipelineID
+	s.stageIndex = env.StageIndex
+}
@@ -0,0 +1,175 @@
+package pipe_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/go-pipe/pipe"
+)
+
+func TestPipelineID(t *testing.T) {
+	t.Parallel()
+
+	p1, p2 := pipe.New(), pipe.New()
+	assert.NotEmpty(t, p1.ID())
+	assert.NotEqual(t, p1.ID(), p2.ID())
+
+	assert.Equal(t, "request-42", pipe.New(pipe.WithID("request-42")).ID())
+}
+
+func TestPipelineIDEnvVar(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'sh' unavailable")
+	}
+
+	t.Parallel()
+	ctx := context.Background()
+
+	p := pipe.New(pipe.WithID("request-42"))
+	p.Add(
+		pipe.Command("sh", "-c", `echo "$GO_PIPE_ID $GO_PIPE_STAGE_INDEX"`),
+		pipe.Command("sh", "-c", `cat; echo "$GO_PIPE_ID $GO_PIPE_STAGE_INDEX"`),
+	)
+	out, err := p.Output(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "request-42 0\nrequest-42 1\n", string(out))
+
+	script := `echo "${GO_PIPE_ID-unset} ${MY_REQUEST_ID-unset} ${MY_STAGE-unset}"`
+	p = pipe.New(
+		pipe.WithID("request-43"),
+		pipe.WithIDEnvVar("MY_REQUEST_ID"),
+		pipe.WithStageIndexEnvVar("MY_STAGE"),
+	)
+	p.Add(pipe.Command("sh", "-c", script))
+	out, err = p.Output(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "unset request-43 0\n", string(out))
+
+	p = pipe.New(pipe.WithIDEnvVar(""), pipe.WithStageIndexEnvVar(""))
+	p.Add(pipe.Command("sh", "-c", `echo "${GO_PIPE_ID-unset} ${GO_PIPE_STAGE_INDEX-unset}"`))
+	out, err = p.Output(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "unset unset\n", string(out))
+}
+
+func TestPipelineIDInEventsAndErrors(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	var events []*pipe.Event
+
+	p := pipe.New(
+		pipe.WithID("request-42"),
+		pipe.WithEventHandler(func(e *pipe.Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, e)
+		}),
+	)
+	p.Add(
+		pipe.Function(
+			"ok",
+			func(_ context.Context, _ pipe.Env, _ io.Reader, _ io.Writer) error {
+				return nil
+			},
+		),
+		pipe.Function(
+			"fail",
+			func(_ context.Context, env pipe.Env, _ io.Reader, _ io.Writer) error {
+				assert.Equal(t, "request-42", env.PipelineID)
+				return assert.AnError
+			},
+		),
+	)
+	err := p.Run(ctx)
+	require.ErrorIs(t, err, assert.AnError)
+	assert.EqualError(t, err, "pipeline request-42, stage 1: fail: "+assert.AnError.Error())
+
+	var stageErr *pipe.StageError
+	require.True(t, errors.As(err, &stageErr))
+	assert.Equal(t, "request-42", stageErr.PipelineID)
+	assert.Equal(t, "fail", stageErr.Stage)
+	assert.Equal(t, 1, stageErr.StageIndex)
+
+	require.Len(t, events, 1)
+	assert.Equal(t, "request-42", events[0].PipelineID)
+	assert.Equal(t, "fail", events[0].Command)
+	assert.Equal(t, 1, events[0].Context["stage_index"])
+}
+
+func TestPipelineIDInStartError(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	p := pipe.New(pipe.WithID("request-42"))
+	p.Add(ErrorStartingStage{assert.AnError})
+	err := p.Run(ctx)
+	require.ErrorIs(t, err, assert.AnError)
+	assert.EqualError(t, err,
+		`pipeline request-42, stage 0: starting pipeline stage "errorStartingStage": `+
+			assert.AnError.Error(),
+	)
+
+	var stageErr *pipe.StageError
+	require.True(t, errors.As(err, &stageErr))
+	assert.True(t, stageErr.Starting)
+	assert.Equal(t, 0, stageErr.StageIndex)
+}
+
+func TestPipelineIDNotInErrorsByDefault(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	p := pipe.New()
+	p.Add(pipe.Function(
+		"fail",
+		func(context.Context, pipe.Env, io.Reader, io.Writer) error {
+			return assert.AnError
+		},
+	))
+	err := p.Run(ctx)
+	assert.EqualError(t, err, "fail: "+assert.AnError.Error())
+
+	var stageErr *pipe.StageError
+	require.True(t, errors.As(err, &stageErr))
+	assert.Equal(t, p.ID(), stageErr.PipelineID)
+}
+
+func TestPipelineIDInStageEvents(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	// Events that a stage passes to the handler that it was created
+	// with identify the pipeline and stage, too:
+	clock := newManualClock()
+	stage := newFakeLimitableStage()
+	var rec eventRecorder
+	p := pipe.New(pipe.WithID("request-42"))
+	p.Add(
+		pipe.Function(
+			"noop",
+			func(context.Context, pipe.Env, io.Reader, io.Writer) error {
+				return nil
+			},
+		),
+		pipe.MemoryLimit(stage, 100, rec.handle, pipe.WithClock(clock)),
+	)
+	require.NoError(t, p.Start(ctx))
+
+	stage.sample(clock, pipe.ResourceUsage{RSSAnon: 200}, nil)
+	assert.ErrorIs(t, p.Wait(), pipe.ErrMemoryLimitExceeded)
+
+	require.Equal(t, []string{"stage exceeded allowed memory use"}, rec.msgs())
+	e := rec.events[0]
+	assert.Equal(t, "request-42", e.PipelineID)
+	assert.Equal(t, 1, e.Context["stage_index"])
+	assert.False(t, e.Time.IsZero())
+}
@@ -23,6 +23,7 @@ import (
 
 // Check whether this package's test suite leaks any goroutines:
 func TestMain(m *testing.M) {
+	pipe.HelperMain()
 	goleak.VerifyTestMain(m)
 }
 
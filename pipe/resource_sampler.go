@@ -0,0 +1,396 @@
+package pipe
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ResourceUsage is a snapshot of the resources used by a stage
+// (including, for command stages, all of its descendant processes).
+// Values that a stage can't measure are left zero.
+type ResourceUsage struct {
+	// RSSAnon is the resident anonymous memory, in bytes.
+	RSSAnon uint64
+
+	// RSSFile is the resident file-backed memory, in bytes.
+	RSSFile uint64
+
+	// Swap is the amount of swapped-out anonymous memory, in bytes.
+	Swap uint64
+
+	// PSS is the proportional set size, in bytes.
+	PSS uint64
+
+	// Threads is the number of threads.
+	Threads int
+
+	// OpenFDs is the number of open file descriptors.
+	OpenFDs int
+
+	// CPUTime is the total user plus system CPU time consumed.
+	CPUTime time.Duration
+}
+
+// ResourceReporter is implemented by stages that can report more
+// about their resource usage than `LimitableStage.GetRSSAnon()`. If a
+// stage that is being sampled doesn't implement this interface, only
+// the `RSSAnon` field of the samples is filled in.
+type ResourceReporter interface {
+	GetResourceUsage(context.Context) (ResourceUsage, error)
+}
+
+// ResourceWatcher is a policy that is applied to the samples taken by
+// a `ResourceSampler`.
+type ResourceWatcher interface {
+	// Sample is called with each successful sample. If it returns
+	// `true`, the sampler stops sampling the stage.
+	Sample(ctx context.Context, stage LimitableStage, usage ResourceUsage) bool
+
+	// Done is called once when the sampler stops sampling the
+	// stage, with statistics about the sampling.
+	Done(stage LimitableStage, stats SamplerStats)
+}
+
+// SamplerStats contains statistics about the sampling done by a
+// `ResourceSampler`.
+type SamplerStats struct {
+	// Samples is the number of successful samples.
+	Samples int
+
+	// Errors is the number of failed attempts to sample.
+	Errors int
+}
+
+// Clock is the source of time used by a `ResourceSampler`. It can be
+// replaced in tests to avoid real-time sleeps.
+type Clock interface {
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the subset of `time.Ticker` that is used by a
+// `ResourceSampler`.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is a `Clock` based on the `time` package.
+type realClock struct{}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// ResourceSampler periodically samples the resource usage of a
+// stage while it runs, and passes each sample to its watchers.
+type ResourceSampler struct {
+	interval     time.Duration
+	clock        Clock
+	eventHandler func(e *Event)
+	watchers     []ResourceWatcher
+
+	// If `reportEveryError` is set, every failed sample from the
+	// second consecutive one on is reported, not just the second.
+	reportEveryError bool
+}
+
+// SamplerOption is a functional option for a `ResourceSampler`.
+type SamplerOption func(*ResourceSampler)
+
+// WithSampleInterval sets how often the stage is sampled. The
+// default is once per second.
+func WithSampleInterval(d time.Duration) SamplerOption {
+	return func(rs *ResourceSampler) {
+		rs.interval = d
+	}
+}
+
+// WithClock sets the clock that is used to schedule samples.
+func WithClock(clock Clock) SamplerOption {
+	return func(rs *ResourceSampler) {
+		rs.clock = clock
+	}
+}
+
+// WithWatchers adds watchers that are applied to every sample.
+func WithWatchers(watchers ...ResourceWatcher) SamplerOption {
+	return func(rs *ResourceSampler) {
+		rs.watchers = append(rs.watchers, watchers...)
+	}
+}
+
+// WithEveryErrorReported makes the sampler report every failed sample
+// from the second consecutive one on. By default, only the second
+// consecutive failure is reported, until a sample succeeds again.
+func WithEveryErrorReported() SamplerOption {
+	return func(rs *ResourceSampler) {
+		rs.reportEveryError = true
+	}
+}
+
+// NewResourceSampler returns a `ResourceSampler` with all of the
+// `options` applied. Errors getting samples are reported to
+// `eventHandler`.
+func NewResourceSampler(eventHandler func(e *Event), options ...SamplerOption) *ResourceSampler {
+	rs := &ResourceSampler{
+		interval:     memoryPollInterval,
+		clock:        realClock{},
+		eventHandler: eventHandler,
+	}
+
+	for _, option := range options {
+		option(rs)
+	}
+
+	return rs
+}
+
+// SampleResources watches the resource usage of the stage while it
+// runs, applying the watchers that are passed in via `options`.
+// `stage` must implement `LimitableStage`; otherwise, an event is
+// emitted and `stage` is returned unchanged. A sampler holds the
+// state of its watchers, so a new one is created for each stage.
+//
+// The events that the sampler passes to `eventHandler` identify the
+// pipeline and stage, like the pipeline's own events. Watchers pass
+// their events to the handlers that they were created with, so those
+// events don't.
+func SampleResources(stage Stage, eventHandler func(e *Event), options ...SamplerOption) Stage {
+	limitableStage, ok := stage.(LimitableStage)
+	if !ok {
+		eventHandler(&Event{
+			Command: stage.Name(),
+			Msg:     "invalid pipe.SampleResources usage",
+			Err:     fmt.Errorf("invalid pipe.SampleResources usage"),
+		})
+		return stage
+	}
+
+	events := newStageEvents(eventHandler)
+	return &memoryWatchStage{
+		stage:  limitableStage,
+		events: events,
+		watch:  NewResourceSampler(events.handle, options...).Run,
+	}
+}
+
+// Run samples `stage` until `ctx` is done or one of the watchers asks
+// to stop.
+func (rs *ResourceSampler) Run(ctx context.Context, stage LimitableStage) {
+	var stats SamplerStats
+	var consecutiveErrors int
+
+	defer func() {
+		for _, w := range rs.watchers {
+			w.Done(stage, stats)
+		}
+	}()
+
+	t := rs.clock.NewTicker(rs.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C():
+			usage, err := sample(ctx, stage)
+			if err != nil {
+				stats.Errors++
+				consecutiveErrors++
+				if consecutiveErrors == 2 || consecutiveErrors > 2 && rs.reportEveryError {
+					rs.eventHandler(&Event{
+						Command: stage.Name(),
+						Msg:     "error getting RSS",
+						Err:     err,
+					})
+				}
+				// Unless `reportEveryError` is set, don't log any more
+				// errors until we get a sample successfully.
+				continue
+			}
+
+			consecutiveErrors = 0
+			stats.Samples++
+			for _, w := range rs.watchers {
+				if w.Sample(ctx, stage, usage) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// sample returns the current resource usage of `stage`.
+func sample(ctx context.Context, stage LimitableStage) (ResourceUsage, error) {
+	if rr, ok := stage.(ResourceReporter); ok {
+		return rr.GetResourceUsage(ctx)
+	}
+
+	rss, err := stage.GetRSSAnon(ctx)
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+	return ResourceUsage{RSSAnon: rss}, nil
+}
+
+// ObservePeakUsage returns a watcher that records the peak values
+// of the samples, and emits them in a "peak memory usage" event when
+// sampling stops.
+func ObservePeakUsage(eventHandler func(e *Event)) ResourceWatcher {
+	return &peakUsageWatcher{eventHandler: eventHandler}
+}
+
+type peakUsageWatcher struct {
+	eventHandler func(e *Event)
+	peak         ResourceUsage
+}
+
+func (w *peakUsageWatcher) Sample(_ context.Context, _ LimitableStage, usage ResourceUsage) bool {
+	w.peak.RSSAnon = maxUint64(w.peak.RSSAnon, usage.RSSAnon)
+	w.peak.RSSFile = maxUint64(w.peak.RSSFile, usage.RSSFile)
+	w.peak.Swap = maxUint64(w.peak.Swap, usage.Swap)
+	w.peak.PSS = maxUint64(w.peak.PSS, usage.PSS)
+	if usage.Threads > w.peak.Threads {
+		w.peak.Threads = usage.Threads
+	}
+	if usage.OpenFDs > w.peak.OpenFDs {
+		w.peak.OpenFDs = usage.OpenFDs
+	}
+	if usage.CPUTime > w.peak.CPUTime {
+		w.peak.CPUTime = usage.CPUTime
+	}
+	return false
+}
+
+func (w *peakUsageWatcher) Done(stage LimitableStage, stats SamplerStats) {
+	w.eventHandler(&Event{
+		Command: stage.Name(),
+		Msg:     "peak memory usage",
+		Context: map[string]interface{}{
+			"max_rss_bytes":      w.peak.RSSAnon,
+			"max_rss_file_bytes": w.peak.RSSFile,
+			"max_swap_bytes":     w.peak.Swap,
+			"max_pss_bytes":      w.peak.PSS,
+			"max_threads":        w.peak.Threads,
+			"max_open_fds":       w.peak.OpenFDs,
+			"cpu_time":           w.peak.CPUTime,
+			"samples":            stats.Samples,
+			"errors":             stats.Errors,
+		},
+	})
+}
+
+// KillAtMemoryLimit returns a watcher that kills the stage with
+// `ErrMemoryLimitExceeded` as soon as a sample shows that its
+// `RSSAnon` has reached `byteLimit`.
+func KillAtMemoryLimit(byteLimit uint64, eventHandler func(e *Event)) ResourceWatcher {
+	return &limitWatcher{byteLimit: byteLimit, eventHandler: eventHandler}
+}
+
+type limitWatcher struct {
+	byteLimit    uint64
+	eventHandler func(e *Event)
+
+	// tier, if set, is added to the event's context as "tier".
+	tier string
+}
+
+func (w *limitWatcher) Sample(_ context.Context, stage LimitableStage, usage ResourceUsage) bool {
+	if usage.RSSAnon < w.byteLimit {
+		return false
+	}
+	context := map[string]interface{}{
+		"limit": w.byteLimit,
+		"used":  usage.RSSAnon,
+	}
+	if w.tier != "" {
+		context["tier"] = w.tier
+	}
+	w.eventHandler(&Event{
+		Command: stage.Name(),
+		Msg:     "stage exceeded allowed memory use",
+		Err:     fmt.Errorf("stage exceeded allowed memory use"),
+		Context: context,
+	})
+	stage.Kill(ErrMemoryLimitExceeded)
+	return true
+}
+
+func (w *limitWatcher) Done(LimitableStage, SamplerStats) {}
+
+// WarnAtMemoryThreshold returns a watcher that emits an event when a
+// sample shows that the stage's `RSSAnon` has reached
+// `byteThreshold`. The stage is left running. It is equivalent to
+// `SoftMemoryLimit(byteThreshold, nil, eventHandler)`.
+func WarnAtMemoryThreshold(byteThreshold uint64, eventHandler func(e *Event)) ResourceWatcher {
+	return SoftMemoryLimit(byteThreshold, nil, eventHandler)
+}
+
+// SoftMemoryLimit returns a watcher that emits an event when a sample
+// shows that the stage's `RSSAnon` has reached `byteLimit` and, if
+// `sig` is not nil and the stage implements `SignalableStage`, sends
+// `sig` to the stage so that it can shed memory or checkpoint. The
+// stage is left running. The watcher fires again only after the
+// stage's memory use has dropped back below `byteLimit`.
+func SoftMemoryLimit(byteLimit uint64, sig os.Signal, eventHandler func(e *Event)) ResourceWatcher {
+	return &softLimitWatcher{byteLimit: byteLimit, sig: sig, eventHandler: eventHandler}
+}
+
+type softLimitWatcher struct {
+	byteLimit    uint64
+	sig          os.Signal
+	eventHandler func(e *Event)
+	exceeded     bool
+}
+
+func (w *softLimitWatcher) Sample(_ context.Context, stage LimitableStage, usage ResourceUsage) bool {
+	if usage.RSSAnon < w.byteLimit {
+		w.exceeded = false
+		return false
+	}
+	if w.exceeded {
+		return false
+	}
+	w.exceeded = true
+
+	e := &Event{
+		Command: stage.Name(),
+		Msg:     "stage exceeded soft memory limit",
+		Context: map[string]interface{}{
+			"limit": w.byteLimit,
+			"used":  usage.RSSAnon,
+			"tier":  "soft",
+		},
+	}
+	if w.sig != nil {
+		e.Context["signal"] = w.sig.String()
+		if ss, ok := stage.(SignalableStage); ok {
+			e.Err = ss.Signal(w.sig)
+		} else {
+			e.Err = fmt.Errorf("stage %q cannot be signaled", stage.Name())
+		}
+	}
+	w.eventHandler(e)
+
+	return false
+}
+
+func (w *softLimitWatcher) Done(LimitableStage, SamplerStats) {}
+
+func maxUint64(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,339 @@
+package pipe_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/go-pipe/pipe"
+)
+
+// manualClock is a `pipe.Clock` whose tickers only tick when `Tick()`
+// is called.
+type manualClock struct {
+	ch chan time.Time
+}
+
+func newManualClock() *manualClock {
+	return &manualClock{ch: make(chan time.Time)}
+}
+
+func (c *manualClock) NewTicker(time.Duration) pipe.Ticker {
+	return c
+}
+
+func (c *manualClock) C() <-chan time.Time {
+	return c.ch
+}
+
+func (c *manualClock) Stop() {}
+
+// Tick blocks until the sampler has received the tick.
+func (c *manualClock) Tick() {
+	c.ch <- time.Time{}
+}
+
+type sampleResult struct {
+	usage pipe.ResourceUsage
+	err   error
+}
+
+// fakeLimitableStage is a `pipe.LimitableStage` that reports the
+// usage that is sent to it via `sample()`, and runs until it is
+// killed or `finish()` is called.
+type fakeLimitableStage struct {
+	results chan sampleResult
+	done    chan struct{}
+	once    sync.Once
+	killErr error
+
+	mu      sync.Mutex
+	signals []os.Signal
+}
+
+func newFakeLimitableStage() *fakeLimitableStage {
+	return &fakeLimitableStage{
+		results: make(chan sampleResult),
+		done:    make(chan struct{}),
+	}
+}
+
+func (s *fakeLimitableStage) Name() string {
+	return "fake"
+}
+
+func (s *fakeLimitableStage) Start(context.Context, pipe.Env, io.ReadCloser) (io.ReadCloser, error) {
+	return nil, nil
+}
+
+func (s *fakeLimitableStage) Wait() error {
+	<-s.done
+	return s.killErr
+}
+
+// sample makes `clock` tick, then hands `usage` and `err` to the
+// sampler as the result of the sample that it triggers.
+func (s *fakeLimitableStage) sample(clock *manualClock, usage pipe.ResourceUsage, err error) {
+	clock.Tick()
+	s.results <- sampleResult{usage: usage, err: err}
+}
+
+func (s *fakeLimitableStage) GetResourceUsage(ctx context.Context) (pipe.ResourceUsage, error) {
+	select {
+	case r := <-s.results:
+		return r.usage, r.err
+	case <-ctx.Done():
+		return pipe.ResourceUsage{}, ctx.Err()
+	}
+}
+
+func (s *fakeLimitableStage) GetRSSAnon(ctx context.Context) (uint64, error) {
+	u, err := s.GetResourceUsage(ctx)
+	return u.RSSAnon, err
+}
+
+func (s *fakeLimitableStage) Kill(err error) {
+	s.once.Do(func() {
+		s.killErr = err
+		close(s.done)
+	})
+}
+
+func (s *fakeLimitableStage) Signal(sig os.Signal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.signals = append(s.signals, sig)
+	return nil
+}
+
+func (s *fakeLimitableStage) receivedSignals() []os.Signal {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.signals
+}
+
+func (s *fakeLimitableStage) finish() {
+	s.Kill(nil)
+}
+
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []*pipe.Event
+}
+
+func (r *eventRecorder) handle(e *pipe.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *eventRecorder) msgs() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	msgs := make([]string, 0, len(r.events))
+	for _, e := range r.events {
+		msgs = append(msgs, e.Msg)
+	}
+	return msgs
+}
+
+func (r *eventRecorder) last() *pipe.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.events[len(r.events)-1]
+}
+
+func TestResourceSamplerObserve(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	clock := newManualClock()
+	stage := newFakeLimitableStage()
+	var rec eventRecorder
+
+	s := pipe.SampleResources(
+		stage, rec.handle,
+		pipe.WithClock(clock),
+		pipe.WithWatchers(pipe.ObservePeakUsage(rec.handle)),
+	)
+	_, err := s.Start(ctx, pipe.Env{}, nil)
+	require.NoError(t, err)
+
+	stage.sample(clock, pipe.ResourceUsage{RSSAnon: 100, Threads: 4}, nil)
+	stage.sample(clock, pipe.ResourceUsage{RSSAnon: 300, Threads: 2, CPUTime: time.Second}, nil)
+	stage.sample(clock, pipe.ResourceUsage{}, errors.New("oops"))
+	stage.sample(clock, pipe.ResourceUsage{RSSAnon: 200, Threads: 1}, nil)
+
+	stage.finish()
+	require.NoError(t, s.Wait())
+
+	e := rec.last()
+	assert.Equal(t, "peak memory usage", e.Msg)
+	assert.EqualValues(t, 300, e.Context["max_rss_bytes"])
+	assert.EqualValues(t, 4, e.Context["max_threads"])
+	assert.EqualValues(t, time.Second, e.Context["cpu_time"])
+	assert.EqualValues(t, 3, e.Context["samples"])
+	assert.EqualValues(t, 1, e.Context["errors"])
+}
+
+func TestResourceSamplerWarnAndKill(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	clock := newManualClock()
+	stage := newFakeLimitableStage()
+	var rec eventRecorder
+
+	s := pipe.SampleResources(
+		stage, rec.handle,
+		pipe.WithClock(clock),
+		pipe.WithWatchers(
+			pipe.WarnAtMemoryThreshold(100, rec.handle),
+			pipe.KillAtMemoryLimit(200, rec.handle),
+		),
+	)
+	_, err := s.Start(ctx, pipe.Env{}, nil)
+	require.NoError(t, err)
+
+	stage.sample(clock, pipe.ResourceUsage{RSSAnon: 50}, nil)
+	assert.Empty(t, rec.msgs())
+
+	stage.sample(clock, pipe.ResourceUsage{RSSAnon: 150}, nil)
+	stage.sample(clock, pipe.ResourceUsage{RSSAnon: 160}, nil)
+	assert.Equal(t, []string{"stage exceeded soft memory limit"}, rec.msgs())
+
+	stage.sample(clock, pipe.ResourceUsage{RSSAnon: 250}, nil)
+
+	assert.ErrorIs(t, s.Wait(), pipe.ErrMemoryLimitExceeded)
+	assert.Equal(t,
+		[]string{
+			"stage exceeded soft memory limit",
+			"stage exceeded allowed memory use",
+		},
+		rec.msgs(),
+	)
+	assert.EqualValues(t, 250, rec.last().Context["used"])
+	assert.NotContains(t, rec.last().Context, "tier")
+}
+
+func TestResourceSamplerReportsRepeatedErrors(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	clock := newManualClock()
+	stage := newFakeLimitableStage()
+	var rec eventRecorder
+
+	s := pipe.SampleResources(stage, rec.handle, pipe.WithClock(clock))
+	_, err := s.Start(ctx, pipe.Env{}, nil)
+	require.NoError(t, err)
+
+	oops := errors.New("oops")
+	stage.sample(clock, pipe.ResourceUsage{}, oops)
+	stage.sample(clock, pipe.ResourceUsage{}, oops)
+	stage.sample(clock, pipe.ResourceUsage{}, oops)
+	assert.Equal(t, []string{"error getting RSS"}, rec.msgs())
+
+	stage.finish()
+	require.NoError(t, s.Wait())
+}
+
+func TestResourceSamplerReportsEveryError(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	clock := newManualClock()
+	stage := newFakeLimitableStage()
+	var rec eventRecorder
+
+	s := pipe.SampleResources(
+		stage, rec.handle, pipe.WithClock(clock), pipe.WithEveryErrorReported(),
+	)
+	_, err := s.Start(ctx, pipe.Env{}, nil)
+	require.NoError(t, err)
+
+	oops := errors.New("oops")
+	stage.sample(clock, pipe.ResourceUsage{}, oops)
+	stage.sample(clock, pipe.ResourceUsage{}, oops)
+	stage.sample(clock, pipe.ResourceUsage{}, oops)
+	// The next tick is received only after the last error is handled:
+	stage.sample(clock, pipe.ResourceUsage{}, nil)
+	assert.Equal(t, []string{"error getting RSS", "error getting RSS"}, rec.msgs())
+
+	stage.finish()
+	require.NoError(t, s.Wait())
+}
+
+func TestTieredMemoryLimit(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	clock := newManualClock()
+	stage := newFakeLimitableStage()
+	var rec eventRecorder
+
+	s := pipe.TieredMemoryLimit(
+		stage,
+		pipe.MemoryTiers{Soft: 100, SoftSignal: os.Interrupt, Hard: 200},
+		rec.handle,
+		pipe.WithClock(clock),
+	)
+	assert.Equal(t, "fake with memory limit", s.Name())
+
+	_, err := s.Start(ctx, pipe.Env{}, nil)
+	require.NoError(t, err)
+
+	stage.sample(clock, pipe.ResourceUsage{RSSAnon: 150}, nil)
+	stage.sample(clock, pipe.ResourceUsage{RSSAnon: 160}, nil)
+	// Dropping below the soft limit re-arms it:
+	stage.sample(clock, pipe.ResourceUsage{RSSAnon: 50}, nil)
+	stage.sample(clock, pipe.ResourceUsage{RSSAnon: 170}, nil)
+	stage.sample(clock, pipe.ResourceUsage{RSSAnon: 250}, nil)
+
+	assert.ErrorIs(t, s.Wait(), pipe.ErrMemoryLimitExceeded)
+	assert.Equal(t,
+		[]os.Signal{os.Interrupt, os.Interrupt},
+		stage.receivedSignals(),
+	)
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	require.Len(t, rec.events, 3)
+	for i, tier := range []string{"soft", "soft", "hard"} {
+		assert.Equal(t, tier, rec.events[i].Context["tier"])
+	}
+	assert.EqualValues(t, 100, rec.events[0].Context["limit"])
+	assert.EqualValues(t, 150, rec.events[0].Context["used"])
+	assert.Equal(t, "interrupt", rec.events[0].Context["signal"])
+	assert.EqualValues(t, 200, rec.events[2].Context["limit"])
+	assert.EqualValues(t, 250, rec.events[2].Context["used"])
+}
+
+func TestTieredMemoryLimitWithoutHardLimit(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	clock := newManualClock()
+	stage := newFakeLimitableStage()
+	var rec eventRecorder
+
+	s := pipe.TieredMemoryLimit(
+		stage, pipe.MemoryTiers{Soft: 100}, rec.handle, pipe.WithClock(clock),
+	)
+	_, err := s.Start(ctx, pipe.Env{}, nil)
+	require.NoError(t, err)
+
+	stage.sample(clock, pipe.ResourceUsage{RSSAnon: 150}, nil)
+	stage.sample(clock, pipe.ResourceUsage{RSSAnon: 1 << 40}, nil)
+
+	stage.finish()
+	require.NoError(t, s.Wait())
+	assert.Equal(t, []string{"stage exceeded soft memory limit"}, rec.msgs())
+}
@@ -0,0 +1,93 @@
+package pipe
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrCPULimitExceeded is the error that a command stage returns
+	// if it was killed by SIGXCPU, which the kernel sends when the
+	// process reaches the soft `RlimitCPU` limit.
+	ErrCPULimitExceeded = errors.New("CPU time limit exceeded")
+
+	// ErrFileSizeLimitExceeded is the error that a command stage
+	// returns if it was killed by SIGXFSZ, which the kernel sends
+	// when the process tries to grow a file beyond `RlimitFSIZE`.
+	ErrFileSizeLimitExceeded = errors.New("file size limit exceeded")
+)
+
+// RlimitResource identifies a resource that can be limited by an
+// `Rlimit`.
+type RlimitResource int
+
+const (
+	// RlimitAS limits the size of the process's address space, in
+	// bytes.
+	RlimitAS RlimitResource = iota
+
+	// RlimitNOFILE limits the number of open file descriptors.
+	RlimitNOFILE
+
+	// RlimitFSIZE limits the size of files that the process can
+	// create, in bytes.
+	RlimitFSIZE
+
+	// RlimitCPU limits the CPU time used by the process, in seconds.
+	RlimitCPU
+
+	// RlimitCORE limits the size of core dumps, in bytes.
+	RlimitCORE
+)
+
+func (r RlimitResource) String() string {
+	switch r {
+	case RlimitAS:
+		return "RLIMIT_AS"
+	case RlimitNOFILE:
+		return "RLIMIT_NOFILE"
+	case RlimitFSIZE:
+		return "RLIMIT_FSIZE"
+	case RlimitCPU:
+		return "RLIMIT_CPU"
+	case RlimitCORE:
+		return "RLIMIT_CORE"
+	default:
+		return fmt.Sprintf("RlimitResource(%d)", int(r))
+	}
+}
+
+// RlimInfinity can be used as the `Soft` or `Hard` value of an
+// `Rlimit` to mean "no limit".
+const RlimInfinity = ^uint64(0)
+
+// Rlimit is a resource limit that is applied to a command stage.
+type Rlimit struct {
+	Resource RlimitResource
+	Soft     uint64
+	Hard     uint64
+}
+
+// WithRlimits arranges for `limits` to be applied to the command
+// stage `stage` and returns `stage`. It panics if `stage` is not a
+// command stage.
+//
+// Rlimits are an attribute of a whole process, so they can't be set in
+// this process without affecting it, too. Instead, the command is
+// started via a helper process, which is this program itself,
+// re-executed via `/proc/self/exe`: it sets the limits on itself and
+// then executes the command, which inherits them (as do any processes
+// that the command starts). So `HelperMain()` must be called at the
+// start of `main()`, and if the stage has a filesystem policy, it must
+// allow executing this program. (A sandboxed command gets its limits
+// from the sandbox's init process instead.) Setting rlimits is only
+// supported on Linux; elsewhere, starting the stage fails.
+//
+// If the command is killed for exceeding its `RlimitCPU` or
+// `RlimitFSIZE` soft limit, the stage's error is
+// `ErrCPULimitExceeded` or `ErrFileSizeLimitExceeded`, respectively.
+func WithRlimits(stage Stage, limits ...Rlimit) Stage {
+	s := mustCommandStage(stage, "WithRlimits")
+	s.rlimits = append(s.rlimits, limits...)
+	return stage
+}
@@ -0,0 +1,187 @@
+//go:build linux
+
+package pipe
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// rlimitEnvVar is the environment variable through which the rlimit
+// helper process receives its configuration. Its presence is also what
+// makes `HelperMain()` run the helper.
+const rlimitEnvVar = "_GO_PIPE_RLIMIT_EXEC"
+
+var rlimitResources = map[RlimitResource]int{
+	RlimitAS:     syscall.RLIMIT_AS,
+	RlimitNOFILE: syscall.RLIMIT_NOFILE,
+	RlimitFSIZE:  syscall.RLIMIT_FSIZE,
+	RlimitCPU:    syscall.RLIMIT_CPU,
+	RlimitCORE:   syscall.RLIMIT_CORE,
+}
+
+// rlimitHelperConfig is passed to the rlimit helper process.
+type rlimitHelperConfig struct {
+	// Path is the command to execute once the limits are set.
+	Path string
+
+	Limits []Rlimit
+
+	// StatusFD is a file descriptor that the helper reports errors
+	// to. It is closed when the command is executed.
+	StatusFD int
+}
+
+// rlimitHelper holds the parent's side of the pipe that the rlimit
+// helper reports errors to.
+type rlimitHelper struct {
+	statusR, statusW *os.File
+}
+
+// setupRlimits arranges for the stage's rlimits, if any, to be set
+// before the command is executed. If the command runs in a sandbox,
+// the sandbox's init process sets them. Otherwise, the process that is
+// actually started is the rlimit helper (see `runRlimitHelper()`),
+// which sets them on itself and then executes the command.
+func (s *commandStage) setupRlimits() error {
+	if len(s.rlimits) == 0 {
+		return nil
+	}
+
+	for _, l := range s.rlimits {
+		if _, ok := rlimitResources[l.Resource]; !ok {
+			return fmt.Errorf("unsupported rlimit resource %v", l.Resource)
+		}
+	}
+
+	if s.sandbox != nil {
+		return nil
+	}
+
+	if err := checkHelperMain(); err != nil {
+		return fmt.Errorf("rlimits: %w", err)
+	}
+
+	statusR, statusW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("rlimits: %w", err)
+	}
+	s.rlimitHelper = &rlimitHelper{statusR: statusR, statusW: statusW}
+
+	cfg := rlimitHelperConfig{
+		Path:     s.cmd.Path,
+		Limits:   s.rlimits,
+		StatusFD: 3 + len(s.cmd.ExtraFiles),
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		s.releaseRlimits()
+		return fmt.Errorf("rlimits: %w", err)
+	}
+
+	if s.cmd.Env == nil {
+		s.cmd.Env = os.Environ()
+	}
+	s.cmd.Env = append(s.cmd.Env, rlimitEnvVar+"="+string(data))
+
+	// `s.cmd.Args` are left alone, so that the helper has the same
+	// `argv` as the command.
+	s.cmd.Path = "/proc/self/exe"
+	s.cmd.ExtraFiles = append(
+		s.cmd.ExtraFiles[:len(s.cmd.ExtraFiles):len(s.cmd.ExtraFiles)], statusW,
+	)
+
+	return nil
+}
+
+// applyRlimits waits until the rlimit helper has either executed the
+// command or failed to, and returns its error in the latter case.
+func (s *commandStage) applyRlimits() error {
+	rh := s.rlimitHelper
+	if rh == nil {
+		return nil
+	}
+	defer s.releaseRlimits()
+
+	// The helper has its own copy of this:
+	_ = rh.statusW.Close()
+	rh.statusW = nil
+
+	msg, err := io.ReadAll(rh.statusR)
+	switch {
+	case err != nil:
+		return fmt.Errorf("rlimits: %w", err)
+	case len(msg) != 0:
+		return errors.New(strings.TrimSuffix(string(msg), "\n"))
+	default:
+		return nil
+	}
+}
+
+// releaseRlimits closes the pipe to the rlimit helper.
+func (s *commandStage) releaseRlimits() {
+	rh := s.rlimitHelper
+	if rh == nil {
+		return
+	}
+	for _, f := range []*os.File{rh.statusR, rh.statusW} {
+		if f != nil {
+			_ = f.Close()
+		}
+	}
+	s.rlimitHelper = nil
+}
+
+// setRlimits sets `limits` on the current process.
+func setRlimits(limits []Rlimit) error {
+	for _, l := range limits {
+		resource, ok := rlimitResources[l.Resource]
+		if !ok {
+			return fmt.Errorf("unsupported rlimit resource %v", l.Resource)
+		}
+		// `syscall.Setrlimit()` also tells `syscall.Exec()` not to
+		// restore the `RLIMIT_NOFILE` that the Go runtime started
+		// with:
+		if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: l.Soft, Max: l.Hard}); err != nil {
+			return fmt.Errorf("setting %v: %w", l.Resource, err)
+		}
+	}
+	return nil
+}
+
+// runRlimitHelper is the main function of the rlimit helper process.
+// It sets the limits on itself, then executes the command, which
+// inherits them. It never returns.
+func runRlimitHelper(data string) {
+	var cfg rlimitHelperConfig
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "go-pipe rlimits: invalid configuration: %v\n", err)
+		os.Exit(127)
+	}
+
+	syscall.CloseOnExec(cfg.StatusFD)
+	status := os.NewFile(uintptr(cfg.StatusFD), "rlimit-status")
+	fail := func(err error) {
+		fmt.Fprintf(status, "rlimits: %s\n", strings.ReplaceAll(err.Error(), "\n", " "))
+		os.Exit(127)
+	}
+
+	if err := setRlimits(cfg.Limits); err != nil {
+		fail(err)
+	}
+
+	env := make([]string, 0, len(os.Environ()))
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, rlimitEnvVar+"=") {
+			env = append(env, kv)
+		}
+	}
+
+	err := syscall.Exec(cfg.Path, os.Args, env)
+	fail(fmt.Errorf("executing %s: %w", cfg.Path, err))
+}
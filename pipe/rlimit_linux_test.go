@@ -0,0 +1,77 @@
+//go:build linux
+
+package pipe_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/go-pipe/pipe"
+)
+
+func TestRlimitNOFILE(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	p := pipe.New()
+	p.Add(pipe.WithRlimits(
+		pipe.Command("sh", "-c", "ulimit -Sn; ulimit -Hn"),
+		pipe.Rlimit{Resource: pipe.RlimitNOFILE, Soft: 42, Hard: 64},
+	))
+	out, err := p.Output(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "42\n64\n", string(out))
+}
+
+func TestRlimitCPU(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	p := pipe.New()
+	p.Add(pipe.WithRlimits(
+		pipe.Command("sh", "-c", "while :; do :; done"),
+		pipe.Rlimit{Resource: pipe.RlimitCPU, Soft: 1, Hard: 10},
+	))
+	assert.ErrorIs(t, p.Run(ctx), pipe.ErrCPULimitExceeded)
+}
+
+func TestRlimitFSIZE(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	dir := t.TempDir()
+
+	p := pipe.New(pipe.WithDir(dir))
+	p.Add(pipe.WithRlimits(
+		pipe.Command("sh", "-c", "exec head -c 100000 /dev/zero >"+filepath.Join(dir, "out")),
+		pipe.Rlimit{Resource: pipe.RlimitFSIZE, Soft: 1000, Hard: 1000},
+	))
+	assert.ErrorIs(t, p.Run(ctx), pipe.ErrFileSizeLimitExceeded)
+}
+
+func TestRlimitHelperError(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	p := pipe.New()
+	p.Add(pipe.WithRlimits(
+		pipe.Command("true"),
+		pipe.Rlimit{Resource: pipe.RlimitNOFILE, Soft: 64, Hard: 42},
+	))
+	err := p.Run(ctx)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "setting RLIMIT_NOFILE")
+	}
+}
+
+func TestRlimitsRequireCommandStage(t *testing.T) {
+	t.Parallel()
+
+	assert.Panics(t, func() {
+		pipe.WithRlimits(pipe.Println("hello"), pipe.Rlimit{Resource: pipe.RlimitCORE})
+	})
+}
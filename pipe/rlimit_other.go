@@ -0,0 +1,24 @@
+//go:build !linux
+
+package pipe
+
+import "errors"
+
+// rlimitHelper is a placeholder on platforms that don't support
+// rlimits.
+type rlimitHelper struct{}
+
+// setupRlimits fails if any rlimits were requested, because they are
+// only supported on Linux.
+func (s *commandStage) setupRlimits() error {
+	if len(s.rlimits) != 0 {
+		return errors.New("rlimits are only supported on Linux")
+	}
+	return nil
+}
+
+func (s *commandStage) applyRlimits() error {
+	return nil
+}
+
+func (s *commandStage) releaseRlimits() {}
@@ -0,0 +1,117 @@
+package pipe
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// ErrSandboxUnavailable is the error returned when starting a
+// sandboxed command stage on a system where unprivileged user
+// namespaces are not available (e.g., because they are disabled via
+// `sysctl`, or because the process is already running in a restricted
+// container).
+var ErrSandboxUnavailable = errors.New("sandbox: unprivileged user namespaces are not available")
+
+// Sandbox describes how a command stage is isolated from the rest of
+// the system by `WithStageSandbox()`.
+//
+// The command runs in new user, mount, PID, IPC, and network
+// namespaces. Its root filesystem is an empty, read-only `tmpfs`
+// containing only:
+//
+//   - the paths listed in `ReadOnly` and `ReadWrite`, bind-mounted at
+//     the same paths (mount points below them are not included);
+//   - a private `/proc` for the new PID namespace;
+//   - a minimal `/dev` (`null`, `zero`, `full`, `random`, and
+//     `urandom`);
+//   - a private, empty, writable `/tmp`.
+//
+// The network namespace contains no interfaces except a loopback
+// interface that is down, so the command has no network access.
+//
+// Everything the command needs, including the command itself and its
+// shared libraries (typically `/usr`, `/lib`, etc.), has to be listed
+// explicitly. The command's directory (see `WithDir()`) has to be
+// visible in the sandbox, too.
+type Sandbox struct {
+	// ReadOnly are paths that are made visible, read-only, in the
+	// sandbox.
+	ReadOnly []string
+
+	// ReadWrite are paths that are made visible, and writable, in the
+	// sandbox.
+	ReadWrite []string
+}
+
+// WithStageSandbox arranges for the command stage `stage` to be run
+// in a sandbox as described by `sb`. It returns `stage`. It panics if
+// `stage` is not a command stage. Sandboxes are only supported on
+// Linux; elsewhere, starting the stage fails.
+//
+// The sandbox is set up by a small init process, which is this
+// program itself, re-executed via `/proc/self/exe`; it takes over when
+// `main()` calls `HelperMain()`, which is therefore required in
+// programs that use sandboxes (otherwise, starting the stage fails).
+// The init process
+// runs as PID 1 of the new PID namespace and starts the command as its
+// child, in a nested user namespace so that the command can't undo the
+// mounts. When the command exits, the init process exits too, and the
+// kernel kills any other processes left in the sandbox, so the whole
+// process tree dies with the stage.
+//
+// If the command fails, the stage's error is a `*SandboxExitError`.
+// Its `WaitStatus` tells whether the command was killed by a signal,
+// whereas its `ExitCode()` reports the init process's exit status,
+// which in that case is 128 plus the signal number.
+func WithStageSandbox(stage Stage, sb Sandbox) Stage {
+	s := mustCommandStage(stage, "WithStageSandbox")
+	s.sandbox = &sb
+	return stage
+}
+
+// SandboxExitError is the error of a sandboxed command that failed
+// (see `WithStageSandbox()`). It wraps the `*exec.ExitError` of the
+// sandbox's init process, so `errors.As()` still finds the latter.
+type SandboxExitError struct {
+	*exec.ExitError
+
+	// WaitStatus is the wait status of the command itself, as
+	// reported by the init process.
+	WaitStatus syscall.WaitStatus
+}
+
+func (e *SandboxExitError) Error() string {
+	switch {
+	case e.WaitStatus.Signaled():
+		return fmt.Sprintf("signal: %v", e.WaitStatus.Signal())
+	case e.WaitStatus.Exited():
+		return fmt.Sprintf("exit status %d", e.WaitStatus.ExitStatus())
+	default:
+		return e.ExitError.Error()
+	}
+}
+
+func (e *SandboxExitError) Unwrap() error {
+	return e.ExitError
+}
+
+// exitWaitStatus returns the wait status of the command that failed
+// with `err`, if `err` is (or wraps) an `*exec.ExitError`. For
+// sandboxed commands, this is the status of the command itself rather
+// than that of the sandbox's init process.
+func exitWaitStatus(err error) (syscall.WaitStatus, bool) {
+	var sErr *SandboxExitError
+	if errors.As(err, &sErr) {
+		return sErr.WaitStatus, true
+	}
+
+	var eErr *exec.ExitError
+	if !errors.As(err, &eErr) {
+		var ws syscall.WaitStatus
+		return ws, false
+	}
+	ws, ok := eErr.Sys().(syscall.WaitStatus)
+	return ws, ok
+}
@@ -0,0 +1,511 @@
+//go:build linux
+
+package pipe
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// sandboxEnvVar is the environment variable through which a sandbox's
+// init process receives its configuration. Its presence is also what
+// makes `HelperMain()` run the init process.
+const sandboxEnvVar = "_GO_PIPE_SANDBOX_INIT"
+
+// sandboxDevices are the device nodes that are made available in the
+// sandbox's `/dev`.
+var sandboxDevices = []string{"null", "zero", "full", "random", "urandom"}
+
+// sandboxConfig is passed to the sandbox's init process.
+type sandboxConfig struct {
+	// Path is the command to run.
+	Path string
+
+	// Dir is the directory to run the command in, or "" for "/".
+	Dir string
+
+	// Root is an empty directory, on which the sandbox's root
+	// filesystem is mounted.
+	Root string
+
+	ReadOnly  []string
+	ReadWrite []string
+
+	// Rlimits are set on the command.
+	Rlimits []Rlimit
+
+	// UID and GID are the user and group IDs that the command runs
+	// as, which are the same as those of this process.
+	UID int
+	GID int
+
+	// GoFD is a file descriptor that reaches EOF when the init
+	// process may proceed. StatusFD is a file descriptor that the
+	// init process reports its progress to. All lower file
+	// descriptors are passed on to the command.
+	GoFD     int
+	StatusFD int
+}
+
+// sandboxProc holds the parent's side of a sandbox that is being set
+// up or is running.
+type sandboxProc struct {
+	root string
+
+	// The init process reads from `goR` and writes to `statusW`;
+	// this process writes to `goW` and reads from `status`.
+	goR, goW         *os.File
+	statusR, statusW *os.File
+	status           *bufio.Reader
+}
+
+// setupSandbox arranges for the command to be started in a sandbox,
+// if one was configured with `WithStageSandbox()`. The process that
+// is actually started is the sandbox's init process (see
+// `runSandboxInit()`), which waits until `startSandbox()` is called.
+func (s *commandStage) setupSandbox() error {
+	if s.sandbox == nil {
+		return nil
+	}
+
+	if s.fsPolicy != nil {
+		// Landlock doesn't allow the init process to set up mounts:
+		return errors.New("sandbox: can't be combined with a filesystem policy")
+	}
+
+	if !userNamespacesAvailable() {
+		return ErrSandboxUnavailable
+	}
+
+	if err := checkHelperMain(); err != nil {
+		return fmt.Errorf("sandbox: %w", err)
+	}
+
+	sp := &sandboxProc{}
+	var err error
+	sp.root, err = os.MkdirTemp("", "go-pipe-sandbox-")
+	if err != nil {
+		return fmt.Errorf("sandbox: %w", err)
+	}
+	s.sandboxProc = sp
+
+	sp.goR, sp.goW, err = os.Pipe()
+	if err != nil {
+		s.releaseSandbox()
+		return fmt.Errorf("sandbox: %w", err)
+	}
+	sp.statusR, sp.statusW, err = os.Pipe()
+	if err != nil {
+		s.releaseSandbox()
+		return fmt.Errorf("sandbox: %w", err)
+	}
+
+	cfg := sandboxConfig{
+		Path:      s.cmd.Path,
+		Dir:       s.cmd.Dir,
+		Root:      sp.root,
+		ReadOnly:  s.sandbox.ReadOnly,
+		ReadWrite: s.sandbox.ReadWrite,
+		Rlimits:   s.rlimits,
+		UID:       os.Getuid(),
+		GID:       os.Getgid(),
+		GoFD:      3 + len(s.cmd.ExtraFiles),
+		StatusFD:  4 + len(s.cmd.ExtraFiles),
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		s.releaseSandbox()
+		return fmt.Errorf("sandbox: %w", err)
+	}
+
+	if s.cmd.Env == nil {
+		s.cmd.Env = os.Environ()
+	}
+	s.cmd.Env = append(s.cmd.Env, sandboxEnvVar+"="+string(data))
+
+	// `s.cmd.Args` are left alone, so that the init process has the
+	// same `argv` as the command.
+	s.cmd.Path = "/proc/self/exe"
+	s.cmd.ExtraFiles = append(
+		s.cmd.ExtraFiles[:len(s.cmd.ExtraFiles):len(s.cmd.ExtraFiles)],
+		sp.goR, sp.statusW,
+	)
+
+	if s.cmd.SysProcAttr == nil {
+		s.cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	attr := s.cmd.SysProcAttr
+	attr.Cloneflags |= syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS |
+		syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWNET
+	// The init process runs as root within the sandbox, which it
+	// needs to set up the mounts:
+	attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: cfg.UID, Size: 1}}
+	attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: cfg.GID, Size: 1}}
+	attr.GidMappingsEnableSetgroups = false
+
+	return nil
+}
+
+// userNamespacesAvailable reports whether this process can (probably)
+// create user namespaces, based on the sysctls that disable them.
+// `sandboxStartError()` catches the remaining cases.
+func userNamespacesAvailable() bool {
+	for _, sysctl := range []string{
+		"/proc/sys/user/max_user_namespaces",
+		// Debian and Ubuntu kernels:
+		"/proc/sys/kernel/unprivileged_userns_clone",
+	} {
+		data, err := os.ReadFile(sysctl)
+		if err == nil && strings.TrimSpace(string(data)) == "0" {
+			return false
+		}
+	}
+	return true
+}
+
+// sandboxStartError interprets `err`, which was returned when starting
+// the command, in case it indicates that user namespaces are not
+// available.
+func (s *commandStage) sandboxStartError(err error) error {
+	if s.sandbox == nil {
+		return err
+	}
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) ||
+		errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EUSERS) {
+		return fmt.Errorf("%w: %v", ErrSandboxUnavailable, err)
+	}
+	return err
+}
+
+// startSandbox lets the sandbox's init process proceed, and waits
+// until it has set up the sandbox and started the command.
+func (s *commandStage) startSandbox() error {
+	sp := s.sandboxProc
+	if sp == nil {
+		return nil
+	}
+
+	// The init process has its own copies of these:
+	_ = sp.goR.Close()
+	sp.goR = nil
+	_ = sp.statusW.Close()
+	sp.statusW = nil
+
+	_ = sp.goW.Close()
+	sp.goW = nil
+
+	sp.status = bufio.NewReader(sp.statusR)
+	line, err := sp.status.ReadString('\n')
+	switch {
+	case line == "ok\n":
+		return nil
+	case err != nil:
+		return errors.New("sandbox: init process exited during setup")
+	default:
+		return fmt.Errorf("sandbox: %s", strings.TrimPrefix(strings.TrimSuffix(line, "\n"), "error: "))
+	}
+}
+
+// finishSandbox records the wait status of the sandboxed command, as
+// reported by the init process, after the init process has exited.
+func (s *commandStage) finishSandbox() {
+	sp := s.sandboxProc
+	if sp == nil || sp.status == nil {
+		return
+	}
+
+	line, _ := sp.status.ReadString('\n')
+	if n, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSuffix(line, "\n"), "status "), 10, 32); err == nil {
+		ws := syscall.WaitStatus(n)
+		s.sandboxWaitStatus = &ws
+	}
+}
+
+// releaseSandbox frees the resources held for the sandbox.
+func (s *commandStage) releaseSandbox() {
+	sp := s.sandboxProc
+	if sp == nil {
+		return
+	}
+	for _, f := range []*os.File{sp.goR, sp.goW, sp.statusR, sp.statusW} {
+		if f != nil {
+			_ = f.Close()
+		}
+	}
+	// The sandbox's root filesystem was only ever mounted in the
+	// sandbox's mount namespace, so this is just an empty directory:
+	_ = os.Remove(sp.root)
+	s.sandboxProc = nil
+}
+
+// runSandboxInit is the main function of the sandbox's init process.
+// It never returns.
+func runSandboxInit(data string) {
+	var cfg sandboxConfig
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "go-pipe sandbox: invalid configuration: %v\n", err)
+		os.Exit(127)
+	}
+
+	status := os.NewFile(uintptr(cfg.StatusFD), "sandbox-status")
+	fail := func(err error) {
+		msg := strings.ReplaceAll(err.Error(), "\n", " ")
+		fmt.Fprintf(status, "error: %s\n", msg)
+		os.Exit(127)
+	}
+
+	// Wait until the parent has finished setting up the process
+	// (e.g., its cgroup), so that the command inherits
+	// everything:
+	goR := os.NewFile(uintptr(cfg.GoFD), "sandbox-go")
+	_, _ = io.Copy(io.Discard, goR)
+	_ = goR.Close()
+
+	// As PID 1, this process only receives signals that it handles.
+	// Signals sent to the stage's process group reach the command
+	// directly, so they are just discarded here:
+	sigs := make(chan os.Signal, 16)
+	signal.Notify(sigs)
+	go func() {
+		for range sigs {
+		}
+	}()
+
+	if err := setupSandboxFS(cfg); err != nil {
+		fail(err)
+	}
+
+	// The command inherits these:
+	if err := setRlimits(cfg.Rlimits); err != nil {
+		fail(err)
+	}
+
+	env := make([]string, 0, len(os.Environ()))
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, sandboxEnvVar+"=") {
+			env = append(env, kv)
+		}
+	}
+
+	files := make([]uintptr, cfg.GoFD)
+	for i := range files {
+		files[i] = uintptr(i)
+	}
+
+	dir := cfg.Dir
+	if dir == "" {
+		dir = "/"
+	}
+
+	// Run the command as its original user, in a nested user
+	// namespace. This way, it has no capabilities, and the mounts
+	// set up above are locked.
+	pid, err := syscall.ForkExec(cfg.Path, os.Args, &syscall.ProcAttr{
+		Dir:   dir,
+		Env:   env,
+		Files: files,
+		Sys: &syscall.SysProcAttr{
+			Cloneflags:                 syscall.CLONE_NEWUSER,
+			UidMappings:                []syscall.SysProcIDMap{{ContainerID: cfg.UID, HostID: 0, Size: 1}},
+			GidMappings:                []syscall.SysProcIDMap{{ContainerID: cfg.GID, HostID: 0, Size: 1}},
+			GidMappingsEnableSetgroups: false,
+		},
+	})
+	if err != nil {
+		fail(fmt.Errorf("starting %s: %w", cfg.Path, err))
+	}
+	fmt.Fprint(status, "ok\n")
+
+	// Reap any orphaned processes until the command itself exits:
+	var ws syscall.WaitStatus
+	for {
+		wpid, err := syscall.Wait4(-1, &ws, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "go-pipe sandbox: waiting for command: %v\n", err)
+			os.Exit(127)
+		}
+		if wpid == pid {
+			break
+		}
+	}
+
+	fmt.Fprintf(status, "status %d\n", uint32(ws))
+
+	// Exiting kills any processes that are left in the sandbox.
+	switch {
+	case ws.Exited():
+		os.Exit(ws.ExitStatus())
+	case ws.Signaled():
+		os.Exit(128 + int(ws.Signal()))
+	default:
+		os.Exit(127)
+	}
+}
+
+// setupSandboxFS builds the sandbox's root filesystem as described in
+// `cfg`, and makes it the root of the current mount namespace.
+func setupSandboxFS(cfg sandboxConfig) error {
+	// Make sure that nothing done here propagates to the parent's
+	// mount namespace:
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %w", err)
+	}
+
+	root := cfg.Root
+	if err := syscall.Mount("tmpfs", root, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755"); err != nil {
+		return fmt.Errorf("mounting root filesystem: %w", err)
+	}
+
+	if err := os.Mkdir(filepath.Join(root, "tmp"), 0o1777); err != nil {
+		return err
+	}
+	if err := syscall.Mount(
+		"tmpfs", filepath.Join(root, "tmp"), "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777",
+	); err != nil {
+		return fmt.Errorf("mounting /tmp: %w", err)
+	}
+
+	for _, path := range cfg.ReadOnly {
+		if err := bindMount(root, path, false); err != nil {
+			return err
+		}
+	}
+	for _, path := range cfg.ReadWrite {
+		if err := bindMount(root, path, true); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, "dev"), 0o755); err != nil {
+		return err
+	}
+	for _, dev := range sandboxDevices {
+		if err := bindMount(root, filepath.Join("/dev", dev), true); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, "proc"), 0o555); err != nil {
+		return err
+	}
+	if err := syscall.Mount(
+		"proc", filepath.Join(root, "proc"), "proc",
+		syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "",
+	); err != nil {
+		return fmt.Errorf("mounting /proc: %w", err)
+	}
+
+	oldRoot := filepath.Join(root, ".old-root")
+	if err := os.Mkdir(oldRoot, 0o700); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(root, oldRoot); err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	if err := syscall.Unmount("/.old-root", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmounting old root: %w", err)
+	}
+	if err := os.Remove("/.old-root"); err != nil {
+		return err
+	}
+
+	if err := syscall.Mount(
+		"", "/", "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, "",
+	); err != nil {
+		return fmt.Errorf("making root filesystem read-only: %w", err)
+	}
+
+	if cfg.Dir != "" {
+		if fi, err := os.Stat(cfg.Dir); err != nil || !fi.IsDir() {
+			return fmt.Errorf("directory %q is not visible in the sandbox", cfg.Dir)
+		}
+	}
+
+	return nil
+}
+
+// bindMount makes `path` visible at the same path under `root`.
+func bindMount(root, path string, writable bool) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("bind mount %q: path must be absolute", path)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("bind mount: %w", err)
+	}
+
+	target := filepath.Join(root, path)
+	if fi.IsDir() {
+		err = os.MkdirAll(target, 0o755)
+	} else {
+		err = os.MkdirAll(filepath.Dir(target), 0o755)
+		if err == nil {
+			var f *os.File
+			f, err = os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0o644)
+			if err == nil {
+				err = f.Close()
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("bind mount %q: %w", path, err)
+	}
+
+	if err := syscall.Mount(path, target, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("bind mount %q: %w", path, err)
+	}
+	if writable {
+		return nil
+	}
+
+	// A bind mount inherits the flags of the original mount, but
+	// remounting it has to repeat any that are locked (because the
+	// original mount belongs to a more privileged user namespace):
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return fmt.Errorf("bind mount %q: %w", path, err)
+	}
+	flags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY)
+	for _, f := range []struct{ st, ms uintptr }{
+		{stNosuid, syscall.MS_NOSUID},
+		{stNodev, syscall.MS_NODEV},
+		{stNoexec, syscall.MS_NOEXEC},
+		{stNoatime, syscall.MS_NOATIME},
+		{stNodiratime, syscall.MS_NODIRATIME},
+		{stRelatime, syscall.MS_RELATIME},
+	} {
+		if uintptr(st.Flags)&f.st != 0 {
+			flags |= f.ms
+		}
+	}
+	if err := syscall.Mount("", target, "", flags, ""); err != nil {
+		return fmt.Errorf("bind mount %q read-only: %w", path, err)
+	}
+	return nil
+}
+
+// Flags in `Statfs_t.Flags`, which are missing from `syscall`.
+const (
+	stNosuid     = 0x2
+	stNodev      = 0x4
+	stNoexec     = 0x8
+	stNoatime    = 0x400
+	stNodiratime = 0x800
+	stRelatime   = 0x1000
+)
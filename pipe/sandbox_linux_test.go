@@ -0,0 +1,176 @@
+package pipe_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/go-pipe/pipe"
+)
+
+// systemSandbox returns a `pipe.Sandbox` that includes the system
+// directories needed to run ordinary commands, plus `readWrite`.
+func systemSandbox(readWrite ...string) pipe.Sandbox {
+	var sb pipe.Sandbox
+	for _, dir := range []string{"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/etc"} {
+		if _, err := os.Stat(dir); err == nil {
+			sb.ReadOnly = append(sb.ReadOnly, dir)
+		}
+	}
+	sb.ReadWrite = readWrite
+	return sb
+}
+
+// runSandboxed runs `script` with `sh` in a sandbox, skipping the test
+// if sandboxes aren't available.
+func runSandboxed(
+	ctx context.Context, t *testing.T, sb pipe.Sandbox, script string, options ...pipe.Option,
+) (string, error) {
+	t.Helper()
+
+	stdout := &bytes.Buffer{}
+	p := pipe.New(append(options, pipe.WithStdout(stdout))...)
+	p.Add(pipe.WithStageSandbox(pipe.Command("sh", "-c", script), sb))
+	err := p.Run(ctx)
+	if errors.Is(err, pipe.ErrSandboxUnavailable) {
+		t.Skipf("sandboxes are not available: %v", err)
+	}
+	return stdout.String(), err
+}
+
+func TestSandbox(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	rw := t.TempDir()
+	ro := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(ro, "input"), []byte("secret\n"), 0o644))
+
+	sb := systemSandbox(rw)
+	sb.ReadOnly = append(sb.ReadOnly, ro)
+
+	out, err := runSandboxed(
+		ctx, t, sb,
+		`echo "ppid=$PPID"`+
+			` && cat `+ro+`/input`+
+			` && echo hello >`+rw+`/output`+
+			` && ! (echo oops >`+ro+`/output) 2>/dev/null`+
+			` && ! (echo oops >/new-file) 2>/dev/null`+
+			` && echo tmp >/tmp/file && cat /tmp/file`+
+			` && ! test -e `+os.Getenv("HOME")+`/.`+
+			` && grep -c : /proc/net/dev`,
+	)
+	require.NoError(t, err)
+	assert.Equal(t, "ppid=1\nsecret\ntmp\n1\n", out)
+
+	data, err := os.ReadFile(filepath.Join(rw, "output"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", string(data))
+
+	_, err = os.Stat(filepath.Join(ro, "output"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSandboxDir(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	dir := t.TempDir()
+
+	out, err := runSandboxed(ctx, t, systemSandbox(dir), `pwd`, pipe.WithDir(dir))
+	require.NoError(t, err)
+	assert.Equal(t, dir+"\n", out)
+
+	_, err = runSandboxed(ctx, t, systemSandbox(), `pwd`, pipe.WithDir(dir))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "is not visible in the sandbox")
+	}
+}
+
+func TestSandboxMissingMount(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	sb := systemSandbox(filepath.Join(t.TempDir(), "does-not-exist"))
+	_, err := runSandboxed(ctx, t, sb, `true`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "sandbox: bind mount")
+	}
+}
+
+func TestSandboxExitStatus(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	_, err := runSandboxed(ctx, t, systemSandbox(), `exit 3`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "exit status 3")
+	}
+}
+
+func TestSandboxSignal(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	_, err := runSandboxed(ctx, t, systemSandbox(), `kill -TERM $$`)
+	var sErr *pipe.SandboxExitError
+	require.True(t, errors.As(err, &sErr), "%v", err)
+	assert.True(t, sErr.WaitStatus.Signaled())
+	assert.Equal(t, syscall.SIGTERM, sErr.WaitStatus.Signal())
+	assert.Equal(t, 128+int(syscall.SIGTERM), sErr.ExitCode())
+	assert.Contains(t, err.Error(), "signal: terminated")
+	assert.True(t, pipe.IsSignal(syscall.SIGTERM)(err))
+
+	_, err = runSandboxed(ctx, t, systemSandbox(), `kill -PIPE $$`)
+	assert.True(t, pipe.IsSIGPIPE(err), "%v", err)
+}
+
+func TestSandboxKilledTreeDies(t *testing.T) {
+	t.Parallel()
+
+	// The background `sleep` keeps stdout open, so the pipeline can
+	// only finish if it is killed when `sh` exits:
+	start := time.Now()
+	out, err := runSandboxed(context.Background(), t, systemSandbox(), `sleep 100 & echo started`)
+	require.NoError(t, err)
+	assert.Equal(t, "started\n", out)
+	assert.Less(t, time.Since(start), 10*time.Second)
+}
+
+func TestSandboxCanceled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	out, err := runSandboxed(ctx, t, systemSandbox(), `echo started; sleep 100`)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.True(t, strings.HasPrefix(out, "started"))
+}
+
+func TestSandboxRlimits(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	stdout := &bytes.Buffer{}
+	p := pipe.New(pipe.WithStdout(stdout))
+	p.Add(pipe.WithRlimits(
+		pipe.WithStageSandbox(pipe.Command("sh", "-c", "ulimit -Sn; ulimit -Hn"), systemSandbox()),
+		pipe.Rlimit{Resource: pipe.RlimitNOFILE, Soft: 42, Hard: 64},
+	))
+	err := p.Run(ctx)
+	if errors.Is(err, pipe.ErrSandboxUnavailable) {
+		t.Skipf("sandboxes are not available: %v", err)
+	}
+	require.NoError(t, err)
+	assert.Equal(t, "42\n64\n", stdout.String())
+}
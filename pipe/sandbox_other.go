@@ -0,0 +1,28 @@
+//go:build !linux
+
+package pipe
+
+import "errors"
+
+// sandboxProc is a placeholder on platforms that don't support
+// sandboxes.
+type sandboxProc struct{}
+
+func (s *commandStage) setupSandbox() error {
+	if s.sandbox != nil {
+		return errors.New("sandboxes are only supported on Linux")
+	}
+	return nil
+}
+
+func (s *commandStage) sandboxStartError(err error) error {
+	return err
+}
+
+func (s *commandStage) startSandbox() error {
+	return nil
+}
+
+func (s *commandStage) finishSandbox() {}
+
+func (s *commandStage) releaseSandbox() {}
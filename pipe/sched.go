@@ -0,0 +1,111 @@
+package pipe
+
+// IOPriorityClass is an I/O scheduling class, as used by
+// `ioprio_set(2)`.
+type IOPriorityClass int
+
+const (
+	// IOPriorityClassNone means that no class has been set, in which
+	// case the kernel derives the I/O priority from the nice value.
+	IOPriorityClassNone IOPriorityClass = iota
+
+	// IOPriorityClassRealTime gets first access to the disk. Using
+	// it requires privileges.
+	IOPriorityClassRealTime
+
+	// IOPriorityClassBestEffort is the default class.
+	IOPriorityClassBestEffort
+
+	// IOPriorityClassIdle only gets disk time when no other process
+	// needs it.
+	IOPriorityClassIdle
+)
+
+// schedAttrs are the scheduling attributes that a command should be
+// started with. Nil or empty fields are inherited from the current
+// process.
+type schedAttrs struct {
+	nice       *int
+	ioPriority *ioPriority
+	cpus       []int
+}
+
+type ioPriority struct {
+	class IOPriorityClass
+	level int
+}
+
+// isZero returns true if no attributes have been set.
+func (a schedAttrs) isZero() bool {
+	return a.nice == nil && a.ioPriority == nil && a.cpus == nil
+}
+
+// overriddenBy returns the attributes `a`, with any fields that are
+// set in `other` taking precedence.
+func (a schedAttrs) overriddenBy(other schedAttrs) schedAttrs {
+	if other.nice != nil {
+		a.nice = other.nice
+	}
+	if other.ioPriority != nil {
+		a.ioPriority = other.ioPriority
+	}
+	if other.cpus != nil {
+		a.cpus = other.cpus
+	}
+	return a
+}
+
+// WithNice sets the default nice value for the command stages in the
+// pipeline. Lowering the nice value below that of the current process
+// requires privileges. Scheduling options are only supported on
+// Linux; elsewhere, starting a command stage that uses them fails.
+func WithNice(nice int) Option {
+	return func(p *Pipeline) {
+		p.env.sched.nice = &nice
+	}
+}
+
+// WithIOPriority sets the default I/O scheduling class and priority
+// level (0, the highest, through 7) for the command stages in the
+// pipeline.
+func WithIOPriority(class IOPriorityClass, level int) Option {
+	return func(p *Pipeline) {
+		p.env.sched.ioPriority = &ioPriority{class: class, level: level}
+	}
+}
+
+// WithCPUAffinity sets the default set of CPUs that the command
+// stages in the pipeline may run on.
+func WithCPUAffinity(cpus ...int) Option {
+	return func(p *Pipeline) {
+		p.env.sched.cpus = cpus
+	}
+}
+
+// WithStageNice sets the nice value for the command stage `stage`,
+// overriding the pipeline's default, and returns `stage`. It panics if
+// `stage` is not a command stage. The stage's name is not changed, as
+// it would be by wrapping the command in `nice`.
+func WithStageNice(stage Stage, nice int) Stage {
+	s := mustCommandStage(stage, "WithStageNice")
+	s.sched.nice = &nice
+	return stage
+}
+
+// WithStageIOPriority sets the I/O scheduling class and priority level
+// for the command stage `stage`, overriding the pipeline's default,
+// and returns `stage`. It panics if `stage` is not a command stage.
+func WithStageIOPriority(stage Stage, class IOPriorityClass, level int) Stage {
+	s := mustCommandStage(stage, "WithStageIOPriority")
+	s.sched.ioPriority = &ioPriority{class: class, level: level}
+	return stage
+}
+
+// WithStageCPUAffinity sets the CPUs that the command stage `stage`
+// may run on, overriding the pipeline's default, and returns `stage`.
+// It panics if `stage` is not a command stage.
+func WithStageCPUAffinity(stage Stage, cpus ...int) Stage {
+	s := mustCommandStage(stage, "WithStageCPUAffinity")
+	s.sched.cpus = cpus
+	return stage
+}
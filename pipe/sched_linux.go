@@ -0,0 +1,82 @@
+//go:build linux
+
+package pipe
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+// startWithThreadAttrs starts the command with the scheduling
+// attributes `attrs` and the command's filesystem policy, if any.
+//
+// The nice value, I/O priority, CPU affinity, and Landlock
+// restrictions are all attributes of a thread on Linux, and are
+// inherited by a process that is forked from that thread. So we set
+// them on a dedicated OS thread, start the command from there, and let
+// the thread terminate afterwards (by exiting the goroutine without
+// unlocking it), so that the rest of this process is not affected.
+func (s *commandStage) startWithThreadAttrs(attrs schedAttrs) error {
+	if attrs.isZero() && s.fsPolicy == nil {
+		return s.cmd.Start()
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		// Deliberately no `runtime.UnlockOSThread()`.
+
+		if err := attrs.applyToCurrentThread(); err != nil {
+			errCh <- err
+			return
+		}
+		if err := s.restrictFilesystem(); err != nil {
+			errCh <- err
+			return
+		}
+		errCh <- s.cmd.Start()
+	}()
+	return <-errCh
+}
+
+func (a schedAttrs) applyToCurrentThread() error {
+	if a.nice != nil {
+		// On Linux, this only affects the calling thread:
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, *a.nice); err != nil {
+			return fmt.Errorf("setting nice value to %d: %w", *a.nice, err)
+		}
+	}
+
+	if a.ioPriority != nil {
+		prio := int(a.ioPriority.class)<<ioprioClassShift | a.ioPriority.level
+		_, _, errno := syscall.RawSyscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(prio))
+		if errno != 0 {
+			return fmt.Errorf("setting I/O priority: %w", errno)
+		}
+	}
+
+	if a.cpus != nil {
+		var mask [16]uint64 // enough for 1024 CPUs
+		for _, cpu := range a.cpus {
+			if cpu < 0 || cpu >= len(mask)*64 {
+				return fmt.Errorf("setting CPU affinity: invalid CPU %d", cpu)
+			}
+			mask[cpu/64] |= 1 << (uint(cpu) % 64)
+		}
+		_, _, errno := syscall.RawSyscall(
+			syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask)),
+		)
+		if errno != 0 {
+			return fmt.Errorf("setting CPU affinity: %w", errno)
+		}
+	}
+
+	return nil
+}
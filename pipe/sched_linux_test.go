@@ -0,0 +1,47 @@
+//go:build linux
+
+package pipe_test
+
+import (
+	"context"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/go-pipe/pipe"
+)
+
+func TestSchedulingOptions(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	// `getpriority(2)` returns `20 - nice` on Linux:
+	prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+	require.NoError(t, err)
+	myNice := 20 - prio
+
+	p := pipe.New(
+		pipe.WithNice(myNice+3),
+		pipe.WithIOPriority(pipe.IOPriorityClassBestEffort, 6),
+		pipe.WithCPUAffinity(0),
+	)
+	p.Add(
+		pipe.Command("sh", "-c", `nice; ionice; sed -n "s/^Cpus_allowed_list:\s*//p" /proc/self/status; cat`),
+		pipe.WithStageNice(pipe.Command("sh", "-c", "cat; nice"), myNice+5),
+		pipe.WithStageIOPriority(pipe.Command("sh", "-c", "cat; ionice"), pipe.IOPriorityClassIdle, 0),
+	)
+	out, err := p.Output(ctx)
+	require.NoError(t, err)
+	assert.Equal(t,
+		strconv.Itoa(myNice+3)+"\nbest-effort: prio 6\n0\n"+strconv.Itoa(myNice+5)+"\nidle\n",
+		string(out),
+	)
+
+	// The scheduling attributes of this process must be unaffected:
+	prio, err = syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+	require.NoError(t, err)
+	assert.Equal(t, myNice, 20-prio)
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package pipe
+
+import "errors"
+
+// startWithThreadAttrs starts the command, failing if any scheduling
+// attributes were requested, because they are only supported on
+// Linux.
+func (s *commandStage) startWithThreadAttrs(attrs schedAttrs) error {
+	if !attrs.isZero() {
+		return errors.New("scheduling options are only supported on Linux")
+	}
+	if err := s.restrictFilesystem(); err != nil {
+		return err
+	}
+	return s.cmd.Start()
+}
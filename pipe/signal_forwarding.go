@@ -0,0 +1,70 @@
+package pipe
+
+import (
+	"os"
+	"os/signal"
+)
+
+// signalForwarder relays signals received by this process to the
+// command stages of a running pipeline.
+type signalForwarder struct {
+	signals []os.Signal
+	ch      chan os.Signal
+	done    chan struct{}
+}
+
+// WithSignalForwarding arranges for the given signals, when received by
+// this process while the pipeline is running, to be relayed to every
+// command stage's process group. This is needed because command stages
+// run in their own process groups, so, e.g., a Ctrl-C in the terminal
+// doesn't reach them. The signal handler is installed at the end of
+// `Start()` and removed when `Wait()` returns.
+//
+// Note that while the handler is installed, the signals no longer
+// have their default effect on this process (e.g., terminating it);
+// see `signal.Notify()`. If no signals are given, nothing is
+// forwarded. (Unlike `signal.Notify()`, this doesn't mean "all
+// signals", which would include ones like `SIGCHLD` and `SIGURG`.)
+func WithSignalForwarding(signals ...os.Signal) Option {
+	return func(p *Pipeline) {
+		if len(signals) == 0 {
+			p.signalForwarder = nil
+			return
+		}
+		p.signalForwarder = &signalForwarder{signals: signals}
+	}
+}
+
+// start installs the signal handler.
+func (f *signalForwarder) start(p *Pipeline) {
+	f.ch = make(chan os.Signal, 1)
+	f.done = make(chan struct{})
+	signal.Notify(f.ch, f.signals...)
+
+	go func() {
+		defer close(f.done)
+		for sig := range f.ch {
+			if err := p.signalStages(sig); err != nil {
+				p.eventHandler(&Event{
+					Command: "pipeline",
+					Msg:     "failed to forward signal",
+					Err:     err,
+					Context: map[string]interface{}{
+						"signal": sig.String(),
+					},
+				})
+			}
+		}
+	}()
+}
+
+// stop removes the signal handler and waits for the forwarding
+// goroutine to finish.
+func (f *signalForwarder) stop() {
+	if f.ch == nil {
+		return
+	}
+	signal.Stop(f.ch)
+	close(f.ch)
+	<-f.done
+}
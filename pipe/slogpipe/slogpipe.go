@@ -0,0 +1,94 @@
+//go:build go1.21
+
+// Package slogpipe logs the events of `pipe.Pipeline`s using
+// `log/slog`.
+package slogpipe
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+
+	"github.com/github/go-pipe/pipe"
+)
+
+// Keys of the attributes that are added to each log record (on top of
+// the entries of the event's `Context`).
+const (
+	StageKey      = "stage"
+	ErrorKey      = "error"
+	KindKey       = "kind"
+	PipelineIDKey = "pipeline_id"
+)
+
+// WithLogger returns a `pipe.Option` that logs the pipeline's events to
+// `logger`, as described for `EventHandler()`. Lifecycle events are
+// only logged if the pipeline is also created
+// `pipe.WithLifecycleEvents()`.
+func WithLogger(logger *slog.Logger) pipe.Option {
+	return pipe.WithEventHandler(EventHandler(logger))
+}
+
+// EventHandler returns an event handler that logs events to `logger`.
+// The event's `Msg` becomes the message of the log record, and its
+// `Time` the record's time. The stage (`Command`), `Err`, `Kind`, and
+// `PipelineID` become attributes (if they are set), as do the entries
+// of the event's `Context`, in the order of their keys. The level is
+// chosen by `Level()`.
+func EventHandler(logger *slog.Logger) func(e *pipe.Event) {
+	return func(e *pipe.Event) {
+		ctx := context.Background()
+		level := Level(e)
+		if !logger.Enabled(ctx, level) {
+			return
+		}
+
+		r := slog.NewRecord(e.Time, level, e.Msg, 0)
+		if e.Command != "" {
+			r.AddAttrs(slog.String(StageKey, e.Command))
+		}
+		if e.Err != nil {
+			r.AddAttrs(slog.Any(ErrorKey, e.Err))
+		}
+		if e.Kind != "" {
+			r.AddAttrs(slog.String(KindKey, string(e.Kind)))
+		}
+		if e.PipelineID != "" {
+			r.AddAttrs(slog.String(PipelineIDKey, e.PipelineID))
+		}
+
+		keys := make([]string, 0, len(e.Context))
+		for k := range e.Context {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			r.AddAttrs(slog.Any(k, e.Context[k]))
+		}
+
+		_ = logger.Handler().Handle(ctx, r)
+	}
+}
+
+// Level returns the level at which `e` is logged:
+//
+//   - Lifecycle events are logged at `slog.LevelDebug`, unless they
+//     report an error or a kill, in which case they are logged at
+//     `slog.LevelWarn`. (The failure of a pipeline is also reported by
+//     an error-level event of its own.)
+//   - Other events are logged at `slog.LevelError` if they report an
+//     error, or at `slog.LevelInfo` otherwise.
+func Level(e *pipe.Event) slog.Level {
+	switch {
+	case e.Kind == pipe.StageKilled:
+		return slog.LevelWarn
+	case e.Kind != "" && e.Err != nil:
+		return slog.LevelWarn
+	case e.Kind != "":
+		return slog.LevelDebug
+	case e.Err != nil:
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
@@ -0,0 +1,87 @@
+//go:build go1.21
+
+package slogpipe_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/go-pipe/pipe"
+	"github.com/github/go-pipe/pipe/slogpipe"
+)
+
+func TestWithLogger(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	p := pipe.New(
+		pipe.WithID("request-42"), slogpipe.WithLogger(logger), pipe.WithLifecycleEvents(),
+	)
+	p.Add(pipe.Function(
+		"fail",
+		func(context.Context, pipe.Env, io.Reader, io.Writer) error {
+			return errors.New("oops")
+		},
+	))
+	require.Error(t, p.Run(ctx))
+
+	// Only the failure is logged at info level or above; the lifecycle
+	// events without errors are debug-level:
+	var records []map[string]interface{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var r map[string]interface{}
+		require.NoError(t, dec.Decode(&r))
+		records = append(records, r)
+	}
+	require.Len(t, records, 3)
+
+	// The stage's exit comes first, then the failure, then the end of
+	// the pipeline:
+	assert.Equal(t, "WARN", records[0]["level"])
+	assert.Equal(t, "stage exited", records[0]["msg"])
+	assert.Equal(t, "stage_exited", records[0]["kind"])
+
+	r := records[1]
+	assert.Equal(t, "ERROR", r["level"])
+	assert.Equal(t, "command failed", r["msg"])
+	assert.Equal(t, "fail", r["stage"])
+	assert.Equal(t, "oops", r["error"])
+	assert.Equal(t, "request-42", r["pipeline_id"])
+	assert.EqualValues(t, 0, r["stage_index"])
+	assert.NotContains(t, r, "kind")
+
+	assert.Equal(t, "WARN", records[2]["level"])
+	assert.Equal(t, "pipeline finished", records[2]["msg"])
+	assert.Equal(t, "pipeline", records[2]["stage"])
+}
+
+func TestLevel(t *testing.T) {
+	t.Parallel()
+
+	for _, ex := range []struct {
+		event *pipe.Event
+		level slog.Level
+	}{
+		{&pipe.Event{Msg: "peak memory usage"}, slog.LevelInfo},
+		{&pipe.Event{Msg: "command failed", Err: errors.New("oops")}, slog.LevelError},
+		{&pipe.Event{Kind: pipe.StageStarted}, slog.LevelDebug},
+		{&pipe.Event{Kind: pipe.StageExited}, slog.LevelDebug},
+		{&pipe.Event{Kind: pipe.StageExited, Err: errors.New("oops")}, slog.LevelWarn},
+		{&pipe.Event{Kind: pipe.StageKilled, Err: context.Canceled}, slog.LevelWarn},
+		{&pipe.Event{Kind: pipe.PipelineFinished}, slog.LevelDebug},
+	} {
+		assert.Equal(t, ex.level, slogpipe.Level(ex.event), "%+v", ex.event)
+	}
+}
@@ -3,6 +3,7 @@ package pipe
 import (
 	"context"
 	"io"
+	"os"
 )
 
 // Stage is an element of a `Pipeline`.
@@ -32,3 +33,48 @@ type Stage interface {
 	// the context passed to `Start()`.
 	Wait() error
 }
+
+// SignalableStage is implemented by stages that can be sent a signal
+// while they are running. Command stages send the signal to the
+// command's whole process group (on platforms that support process
+// groups).
+type SignalableStage interface {
+	Stage
+
+	// Signal sends `sig` to the stage. It returns an error if the
+	// stage isn't running or the signal couldn't be delivered.
+	Signal(sig os.Signal) error
+}
+
+// unwrapStage returns the stage that is wrapped by `s` if `s` is a
+// stage created by `FilterError()`, `WithStageEnv()`, or
+// `WithStageDir()` (repeatedly, if those are nested), or `s` itself
+// otherwise.
+func unwrapStage(s Stage) Stage {
+	for {
+		switch w := s.(type) {
+		case efStage:
+			s = w.Stage
+		case envStage:
+			s = w.Stage
+		default:
+			return s
+		}
+	}
+}
+
+// asLimitableStage returns `s` as a `LimitableStage`, looking through
+// the wrappers that don't change how a stage runs (see
+// `unwrapStage()`).
+func asLimitableStage(s Stage) (LimitableStage, bool) {
+	ls, ok := unwrapStage(s).(LimitableStage)
+	return ls, ok
+}
+
+// asSignalableStage returns `s` as a `SignalableStage`, looking
+// through the wrappers that don't change how a stage runs (see
+// `unwrapStage()`).
+func asSignalableStage(s Stage) (SignalableStage, bool) {
+	ss, ok := unwrapStage(s).(SignalableStage)
+	return ss, ok
+}
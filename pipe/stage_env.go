@@ -0,0 +1,59 @@
+package pipe
+
+import (
+	"context"
+	"io"
+)
+
+// envStage is a stage that runs another stage with a modified `Env`.
+type envStage struct {
+	Stage
+	vars []EnvVar
+	dir  string
+}
+
+var _ StagePanicHandlerAware = envStage{}
+
+// WithStageEnv returns a stage that acts like `stage`, except that
+// `vars` are added to the `Env` that it is started with, on top of
+// the pipeline's variables (including those computed from the context,
+// like with `WithEnvVarFunc()`). Variables with the same name as
+// pipeline variables override them. This works for any kind of stage;
+// for example, `Function` stages see the variables in `Env.Vars`. To
+// combine it with `MemoryLimit()` and similar functions, which need
+// the command stage itself, apply those first.
+func WithStageEnv(stage Stage, vars ...EnvVar) Stage {
+	return envStage{Stage: stage, vars: vars}
+}
+
+// WithStageDir returns a stage that acts like `stage`, except that
+// the `Env` that it is started with has `Dir` set to `dir`, overriding
+// the pipeline's default directory. (A command stage whose `exec.Cmd`
+// already has a `Dir` still runs there.)
+func WithStageDir(stage Stage, dir string) Stage {
+	return envStage{Stage: stage, dir: dir}
+}
+
+func (s envStage) Start(ctx context.Context, env Env, stdin io.ReadCloser) (io.ReadCloser, error) {
+	if len(s.vars) != 0 {
+		// Copy `env.Vars` and `env.varSources` so that the
+		// pipeline's `Env` is not affected:
+		env.Vars = append([]AppendVars(nil), env.Vars...)
+		env.varSources = append([]string(nil), env.varSources...)
+		env.addVars("WithStageEnv", func(_ context.Context, vars []EnvVar) []EnvVar {
+			return append(vars, s.vars...)
+		})
+	}
+	if s.dir != "" {
+		env.Dir = s.dir
+	}
+	return s.Stage.Start(ctx, env, stdin)
+}
+
+// SetPanicHandler passes the pipeline's panic handler on to the
+// wrapped stage, if it accepts one.
+func (s envStage) SetPanicHandler(ph StagePanicHandler) {
+	if phs, ok := s.Stage.(StagePanicHandlerAware); ok {
+		phs.SetPanicHandler(ph)
+	}
+}
@@ -0,0 +1,116 @@
+package pipe_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/go-pipe/pipe"
+)
+
+type ctxKey struct{}
+
+func TestWithStageEnv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'sh' unavailable")
+	}
+
+	t.Parallel()
+	ctx := context.WithValue(context.Background(), ctxKey{}, "from-context")
+
+	pipelineDir := t.TempDir()
+	stageDir := t.TempDir()
+
+	p := pipe.New(
+		pipe.WithDir(pipelineDir),
+		pipe.WithEnvVar("STAGE_ENV_A", "pipeline"),
+		pipe.WithEnvVar("STAGE_ENV_B", "pipeline"),
+		pipe.WithEnvVarFunc("STAGE_ENV_CTX", func(ctx context.Context) (string, bool) {
+			v, ok := ctx.Value(ctxKey{}).(string)
+			return v, ok
+		}),
+	)
+	p.Add(
+		pipe.WithStageDir(
+			pipe.WithStageEnv(
+				pipe.Command("sh", "-c", `echo "$STAGE_ENV_A $STAGE_ENV_B $STAGE_ENV_CTX"; pwd`),
+				pipe.EnvVar{Key: "STAGE_ENV_B", Value: "stage"},
+			),
+			stageDir,
+		),
+		pipe.Command("sh", "-c", `cat; echo "$STAGE_ENV_A $STAGE_ENV_B $STAGE_ENV_CTX"; pwd`),
+	)
+	out, err := p.Output(ctx)
+	require.NoError(t, err)
+	assert.Equal(t,
+		fmt.Sprintf(
+			"pipeline stage from-context\n%s\npipeline pipeline from-context\n%s\n",
+			stageDir, pipelineDir,
+		),
+		string(out),
+	)
+}
+
+func TestWithStageEnvFunction(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	dir := t.TempDir()
+
+	p := pipe.New(pipe.WithEnvVar("STAGE_ENV_A", "pipeline"))
+	p.Add(pipe.WithStageDir(
+		pipe.WithStageEnv(
+			pipe.Function(
+				"env",
+				func(ctx context.Context, env pipe.Env, _ io.Reader, stdout io.Writer) error {
+					var vars []pipe.EnvVar
+					for _, fn := range env.Vars {
+						vars = fn(ctx, vars)
+					}
+					_, err := fmt.Fprintln(stdout, env.Dir, vars)
+					return err
+				},
+			),
+			pipe.EnvVar{Key: "STAGE_ENV_B", Value: "stage"},
+		),
+		dir,
+	))
+	out, err := p.Output(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, dir+" [{STAGE_ENV_A pipeline} {STAGE_ENV_B stage}]\n", string(out))
+}
+
+func TestWithStageEnvCommandOptions(t *testing.T) {
+	t.Parallel()
+
+	// Command-stage options see through the wrapper:
+	stage := pipe.WithStageEnv(pipe.Command("true"), pipe.EnvVar{Key: "A", Value: "B"})
+	assert.NotPanics(t, func() { pipe.WithStageNice(stage, 1) })
+}
+
+func TestWithStageEnvPanicHandler(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	// The pipeline's panic handler reaches the wrapped stage:
+	p := pipe.New(
+		pipe.WithStagePanicHandler(func(p any) error {
+			return fmt.Errorf("panic handled: %v", p)
+		}),
+	)
+	p.Add(pipe.WithStageEnv(
+		pipe.Function(
+			"panic",
+			func(context.Context, pipe.Env, io.Reader, io.Writer) error {
+				panic("this is a panic")
+			},
+		),
+		pipe.EnvVar{Key: "A", Value: "B"},
+	))
+	assert.ErrorContains(t, p.Run(ctx), "panic handled: this is a panic")
+}
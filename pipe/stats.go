@@ -0,0 +1,138 @@
+package pipe
+
+import (
+	"sync"
+	"time"
+)
+
+// PipelineStats summarize the execution of a pipeline, for example for
+// metrics. See `WithStatsHandler()`.
+type PipelineStats struct {
+	PipelineID string
+	Duration   time.Duration
+
+	// Err is the error that the pipeline failed with, if any.
+	Err error
+
+	Stages []StageStats
+}
+
+// StageStats summarize the execution of one stage of a pipeline.
+type StageStats struct {
+	Name string
+
+	// Started is true if the stage was started. If not, the other
+	// fields are zero.
+	Started bool
+
+	Duration time.Duration
+
+	// Err is the error that the stage itself failed with, if any, as
+	// returned by its `Wait()` method. Errors that are suppressed
+	// using `FilterError()` or `IgnoreError()` aren't reported here.
+	// This can differ from the error that the pipeline failed with;
+	// for example, a stage that fails with a pipe error because the
+	// next stage finished early doesn't make the pipeline fail.
+	Err error
+
+	// BytesIn and BytesOut are the number of bytes that the stage
+	// read from the previous stage and passed to the next one (or to
+	// the pipeline's stdout). They are only counted if the pipeline is
+	// created `WithIOInstrumentation()`; otherwise, they are zero.
+	// Data that is read from the pipeline's stdin isn't counted.
+	BytesIn  int64
+	BytesOut int64
+}
+
+// WithStatsHandler arranges for `handler` to be called with the
+// pipeline's stats when it is done (after `Wait()`, or if `Start()`
+// fails). If this option is used more than once, all of the handlers
+// are called.
+func WithStatsHandler(handler func(stats *PipelineStats)) Option {
+	return func(p *Pipeline) {
+		p.statsHandlers = append(p.statsHandlers, handler)
+	}
+}
+
+// statsRun collects the stats of a pipeline while it runs.
+type statsRun struct {
+	mu     sync.Mutex
+	starts []time.Time
+	stages []StageStats
+}
+
+// startStats starts collecting the pipeline's stats, if it has any
+// stats handlers.
+func (p *Pipeline) startStats() {
+	if len(p.statsHandlers) == 0 {
+		return
+	}
+
+	run := &statsRun{
+		starts: make([]time.Time, len(p.stages)),
+		stages: make([]StageStats, len(p.stages)),
+	}
+	for i, s := range p.stages {
+		run.stages[i].Name = s.Name()
+	}
+	p.stats = run
+	p.observers = append(p.observers, run.observe)
+	p.finishers = append(p.finishers, func(err error) { run.finish(p, err) })
+}
+
+// observe records the stages' lifecycle events.
+func (run *statsRun) observe(e *Event) {
+	i, ok := e.Context["stage_index"].(int)
+	if !ok || i >= len(run.stages) {
+		return
+	}
+
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	switch e.Kind {
+	case StageStarted:
+		run.stages[i].Started = true
+		run.starts[i] = e.Time
+	case StageExited:
+		run.stages[i].Duration = e.Time.Sub(run.starts[i])
+		run.stages[i].Err = e.Err
+	}
+}
+
+// waited records `err`, which the stage with index `i` returned from
+// `Wait()`. This overrides the error from its `StageExited` event,
+// which is emitted by the innermost stage and therefore hasn't been
+// filtered.
+func (run *statsRun) waited(i int, err error) {
+	if i >= len(run.stages) {
+		return
+	}
+
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	run.stages[i].Err = err
+}
+
+// finish passes the pipeline's stats to its handlers. `err` is the
+// error that the pipeline failed with, if any.
+func (run *statsRun) finish(p *Pipeline, err error) {
+	run.mu.Lock()
+	stats := &PipelineStats{
+		PipelineID: p.env.PipelineID,
+		Duration:   time.Since(p.startTime),
+		Err:        err,
+		Stages:     append([]StageStats(nil), run.stages...),
+	}
+	run.mu.Unlock()
+
+	for i := range stats.Stages {
+		if i > 0 {
+			stats.Stages[i].BytesIn = p.bytesOut(i - 1)
+		}
+		stats.Stages[i].BytesOut = p.bytesOut(i)
+	}
+
+	for _, handler := range p.statsHandlers {
+		handler(stats)
+	}
+}
@@ -0,0 +1,124 @@
+package pipe_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/go-pipe/pipe"
+)
+
+func TestWithStatsHandler(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'sh' unavailable")
+	}
+
+	t.Parallel()
+	ctx := context.Background()
+
+	var stats *pipe.PipelineStats
+	p := pipe.New(
+		pipe.WithID("stats"),
+		pipe.WithStatsHandler(func(s *pipe.PipelineStats) { stats = s }),
+		pipe.WithIOInstrumentation(),
+	)
+	p.Add(
+		pipe.Command("printf", "hello world"),
+		pipe.Function(
+			"head",
+			func(_ context.Context, _ pipe.Env, stdin io.Reader, stdout io.Writer) error {
+				_, err := io.CopyN(stdout, stdin, 5)
+				return err
+			},
+		),
+		pipe.Command("sh", "-c", "cat; exit 1"),
+	)
+	out, err := p.Output(ctx)
+	require.Error(t, err)
+	assert.Equal(t, "hello", string(out))
+
+	require.NotNil(t, stats)
+	assert.Equal(t, "stats", stats.PipelineID)
+	assert.Equal(t, err, stats.Err)
+	assert.Positive(t, stats.Duration)
+	require.Len(t, stats.Stages, 3)
+
+	printf := stats.Stages[0]
+	assert.Equal(t, "printf", printf.Name)
+	assert.True(t, printf.Started)
+	assert.Positive(t, printf.Duration)
+	assert.NoError(t, printf.Err)
+	assert.EqualValues(t, 0, printf.BytesIn)
+	assert.EqualValues(t, 11, printf.BytesOut)
+
+	head := stats.Stages[1]
+	assert.Equal(t, "head", head.Name)
+	assert.EqualValues(t, 11, head.BytesIn)
+	assert.EqualValues(t, 5, head.BytesOut)
+
+	sh := stats.Stages[2]
+	assert.Error(t, sh.Err)
+	assert.EqualValues(t, 5, sh.BytesIn)
+	assert.EqualValues(t, 5, sh.BytesOut)
+}
+
+func TestWithStatsHandlerFilteredErrors(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'sh' unavailable")
+	}
+
+	t.Parallel()
+	ctx := context.Background()
+
+	oops := errors.New("oops")
+
+	var stats *pipe.PipelineStats
+	p := pipe.New(pipe.WithStatsHandler(func(s *pipe.PipelineStats) { stats = s }))
+	p.Add(
+		pipe.IgnoreError(
+			pipe.Command("sh", "-c", "exit 3"),
+			func(error) bool { return true },
+		),
+		pipe.FilterError(
+			pipe.Command("sh", "-c", "exit 4"),
+			func(error) error { return oops },
+		),
+	)
+	require.ErrorIs(t, p.Run(ctx), oops)
+
+	require.NotNil(t, stats)
+	require.Len(t, stats.Stages, 2)
+	assert.NoError(t, stats.Stages[0].Err)
+	assert.Equal(t, oops, stats.Stages[1].Err)
+}
+
+func TestWithStatsHandlerStartFailure(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	var stats *pipe.PipelineStats
+	p := pipe.New(pipe.WithStatsHandler(func(s *pipe.PipelineStats) { stats = s }))
+	p.Add(
+		pipe.Function(
+			"ok",
+			func(context.Context, pipe.Env, io.Reader, io.Writer) error { return nil },
+		),
+		pipe.Command("this-command-does-not-exist-anywhere"),
+	)
+	err := p.Start(ctx)
+	require.Error(t, err)
+
+	require.NotNil(t, stats)
+	assert.Equal(t, err, stats.Err)
+	require.Len(t, stats.Stages, 2)
+	assert.True(t, stats.Stages[0].Started)
+	assert.False(t, stats.Stages[1].Started)
+
+	// Without `WithIOInstrumentation()`, bytes aren't counted:
+	assert.Zero(t, stats.Stages[0].BytesOut)
+}
@@ -0,0 +1,134 @@
+package pipe
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrGracePeriodExpired is the error that `Pipeline.Stop()` uses to
+// abort a pipeline that didn't finish within its grace period.
+var ErrGracePeriodExpired = errors.New("pipeline did not stop within its grace period")
+
+// stoppableReader wraps the pipeline's stdin so that `Pipeline.Stop()`
+// can end the input cleanly. After `stop()` has been called, reads
+// return `io.EOF`, including any read that was blocked when the
+// underlying reader was closed.
+type stoppableReader struct {
+	r io.ReadCloser
+
+	mu      sync.Mutex
+	stopped bool
+}
+
+func (sr *stoppableReader) isStopped() bool {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	return sr.stopped
+}
+
+func (sr *stoppableReader) Read(p []byte) (int, error) {
+	if sr.isStopped() {
+		return 0, io.EOF
+	}
+	n, err := sr.r.Read(p)
+	if err != nil && sr.isStopped() {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// stop makes subsequent reads return `io.EOF` and closes the
+// underlying reader to interrupt any read that is in progress.
+func (sr *stoppableReader) stop() {
+	sr.mu.Lock()
+	if sr.stopped {
+		sr.mu.Unlock()
+		return
+	}
+	sr.stopped = true
+	sr.mu.Unlock()
+
+	_ = sr.r.Close()
+}
+
+// stoppableStdin returns `stdin` wrapped in a `stoppableReader` if it
+// is something that `Pipeline.Stop()` can close, or nil otherwise. If
+// `first`, the pipeline's first stage, is a command stage, an
+// `*os.File` is left alone so that it can still be passed directly to
+// the command (closing our copy of it wouldn't affect the command
+// anyway).
+func stoppableStdin(stdin io.Reader, first Stage) *stoppableReader {
+	if _, ok := stdin.(*os.File); ok && isCommandStage(first) {
+		return nil
+	}
+	rc, ok := stdin.(io.ReadCloser)
+	if !ok {
+		return nil
+	}
+	return &stoppableReader{r: rc}
+}
+
+// isCommandStage reports whether `s` is a command stage, possibly
+// wrapped in stages that pass their stdin straight through to it.
+func isCommandStage(s Stage) bool {
+	for {
+		switch w := unwrapStage(s).(type) {
+		case *commandStage:
+			return true
+		case *memoryWatchStage:
+			s = w.stage
+		default:
+			return false
+		}
+	}
+}
+
+// Stop stops the pipeline gracefully. First it ends the pipeline's
+// input: if the reader passed to `WithStdin()` implements `io.Closer`
+// (for example, a network connection), it is closed and the first
+// stage sees EOF. The exception is an `*os.File` that is passed to a
+// command stage, which reads from its own copy of the file descriptor:
+// its input only ends when the file does. Then the stages are given up to `grace` to drain
+// their input and exit on their own. If they haven't done so by then,
+// or if `ctx` is done first, the pipeline is aborted (see `Abort()`)
+// with `ErrGracePeriodExpired` or `ctx.Err()`, which kills the
+// remaining command stages.
+//
+// Stop waits for the pipeline to finish and returns the same error as
+// `Wait()`. It may be called while another goroutine is blocked in
+// `Wait()`, or instead of calling `Wait()`.
+func (p *Pipeline) Stop(ctx context.Context, grace time.Duration) error {
+	if !p.hasStarted() {
+		panic("attempt to stop a pipeline that has not started")
+	}
+
+	if p.stdinStopper != nil {
+		p.stdinStopper.stop()
+	}
+
+	done := make(chan struct{})
+	var err error
+	go func() {
+		defer close(done)
+		err = p.Wait()
+	}()
+
+	t := time.NewTimer(grace)
+	defer t.Stop()
+
+	select {
+	case <-done:
+		return err
+	case <-t.C:
+		p.Abort(ErrGracePeriodExpired)
+	case <-ctx.Done():
+		p.Abort(ctx.Err())
+	}
+
+	<-done
+	return err
+}
@@ -0,0 +1,142 @@
+package pipe_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/go-pipe/pipe"
+)
+
+func TestPipelineStopClosesStdin(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	// The pipe's writer is never closed, so the pipeline could only
+	// finish on its own if `Stop()` ends its input:
+	r, w := io.Pipe()
+	defer w.Close()
+
+	stdout := &bytes.Buffer{}
+	p := pipe.New(pipe.WithStdin(r), pipe.WithStdout(stdout))
+	p.Add(pipe.Function(
+		"copy",
+		func(_ context.Context, _ pipe.Env, stdin io.Reader, stdout io.Writer) error {
+			_, err := io.Copy(stdout, stdin)
+			return err
+		},
+	))
+	require.NoError(t, p.Start(ctx))
+
+	_, err := w.Write([]byte("hello\n"))
+	require.NoError(t, err)
+
+	assert.NoError(t, p.Stop(ctx, 10*time.Second))
+	assert.Equal(t, "hello\n", stdout.String())
+
+	// `Wait()` can still be called, and returns the same result:
+	assert.NoError(t, p.Wait())
+}
+
+func TestPipelineStopClosesFileStdin(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: closing a pipe might not interrupt a read")
+	}
+
+	t.Parallel()
+	ctx := context.Background()
+
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Unlike with an `io.Pipe`, writing doesn't wait for the data to
+	// be read, so the stage says when it has read the first line:
+	readLine := make(chan struct{})
+
+	stdout := &bytes.Buffer{}
+	p := pipe.New(pipe.WithStdin(r), pipe.WithStdout(stdout))
+	p.Add(pipe.Function(
+		"copy",
+		func(_ context.Context, _ pipe.Env, stdin io.Reader, stdout io.Writer) error {
+			if _, err := io.CopyN(stdout, stdin, 6); err != nil {
+				return err
+			}
+			close(readLine)
+			_, err := io.Copy(stdout, stdin)
+			return err
+		},
+	))
+	require.NoError(t, p.Start(ctx))
+
+	_, err = w.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	<-readLine
+
+	assert.NoError(t, p.Stop(ctx, 10*time.Second))
+	assert.Equal(t, "hello\n", stdout.String())
+}
+
+func TestPipelineStopCommandDrains(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'cat' unavailable")
+	}
+
+	t.Parallel()
+	ctx := context.Background()
+
+	r, w := io.Pipe()
+	defer w.Close()
+
+	stdout := &bytes.Buffer{}
+	p := pipe.New(pipe.WithStdin(r), pipe.WithStdout(stdout))
+	p.Add(pipe.Command("cat"))
+	require.NoError(t, p.Start(ctx))
+
+	_, err := w.Write([]byte("hello\n"))
+	require.NoError(t, err)
+
+	assert.NoError(t, p.Stop(ctx, 10*time.Second))
+	assert.Equal(t, "hello\n", stdout.String())
+}
+
+func TestPipelineStopGracePeriodExpired(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'sleep' unavailable")
+	}
+
+	t.Parallel()
+	ctx := context.Background()
+
+	p := pipe.New()
+	p.Add(pipe.Command("sleep", "10"))
+	require.NoError(t, p.Start(ctx))
+
+	start := time.Now()
+	err := p.Stop(ctx, 50*time.Millisecond)
+	assert.ErrorIs(t, err, pipe.ErrGracePeriodExpired)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestPipelineStopContextDone(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'sleep' unavailable")
+	}
+
+	t.Parallel()
+
+	p := pipe.New()
+	p.Add(pipe.Command("sleep", "10"))
+	require.NoError(t, p.Start(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, p.Stop(ctx, time.Hour), context.Canceled)
+}
@@ -0,0 +1,242 @@
+package pipe
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// blockedThreshold is how long passing data on to the next stage must
+// take for the tap to record the previous stage as blocked.
+const blockedThreshold = time.Millisecond
+
+// WithIOInstrumentation arranges for the data that is passed from
+// each stage to the next to be counted, so that byte counts can be
+// reported by `WithTracer()` and `WithStatsHandler()`. This requires an extra copy (and an
+// extra pipe buffer, so a stage whose output would fit in it might
+// not notice that the next stage has stopped reading). Data that is
+// read from the pipeline's stdin isn't counted.
+func WithIOInstrumentation() Option {
+	return func(p *Pipeline) {
+		p.instrumentIO = true
+	}
+}
+
+// streamTap observes the data that flows from one stage's stdout to
+// the next stage's stdin. It is only interposed if the pipeline is
+// instrumented (e.g., using `WithIOInstrumentation()`), because it
+// costs an extra copy.
+type streamTap struct {
+	r io.ReadCloser
+
+	// w is the write end of the pipe whose read end is passed to the
+	// next stage, or nil if the tap is only a counting wrapper around
+	// `r` (see `newCountingTap()`).
+	w *os.File
+
+	// bytes is the number of bytes that have been passed through.
+	bytes int64
+
+	// firstRead is when the first data was read from the previous
+	// stage, and firstWrite when it was passed to the next one.
+	// `blocked` are the intervals during which passing data on took
+	// at least `blockedThreshold`, meaning that the previous stage was
+	// (probably) blocked writing. `lastRead` is when the last read
+	// returned, for counting taps. These are protected by `mu`.
+	mu         sync.Mutex
+	firstRead  time.Time
+	firstWrite time.Time
+	lastRead   time.Time
+	blocked    []interval
+
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// newStreamTap returns a tap that copies `r` into a new pipe, and the
+// read end of that pipe, which should be passed to the next stage.
+// Using an OS-level pipe means that commands can still read their
+// stdin directly.
+func newStreamTap(r io.ReadCloser) (*streamTap, io.ReadCloser, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t := &streamTap{
+		r:    r,
+		w:    pw,
+		done: make(chan struct{}),
+	}
+	go t.copy()
+	return t, pr, nil
+}
+
+// newCountingTap returns a tap that counts the bytes read from `r` via
+// the returned reader, without copying them. This is sufficient if the
+// reader is consumed by the pipeline itself.
+func newCountingTap(r io.ReadCloser) (*streamTap, io.ReadCloser) {
+	t := &streamTap{
+		r:    r,
+		done: make(chan struct{}),
+	}
+	return t, countingReader{t}
+}
+
+func (t *streamTap) copy() {
+	defer close(t.done)
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := t.r.Read(buf)
+		if n > 0 {
+			atomic.AddInt64(&t.bytes, int64(n))
+			start := time.Now()
+			_, err := t.w.Write(buf[:n])
+			t.recordWrite(start, time.Now())
+			if err != nil {
+				// The next stage has stopped reading. Closing `r`
+				// lets the previous stage know, too.
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	_ = t.w.Close()
+	_ = t.r.Close()
+}
+
+// tapOutput returns the reader that should be passed to the stage
+// after stage `i`, whose output is `stdout`. If the pipeline's I/O is
+// instrumented, this is a tap. If the tap can't be set up, the data is
+// passed on uninstrumented.
+func (p *Pipeline) tapOutput(i int, stdout io.ReadCloser) io.ReadCloser {
+	if !p.instrumentIO || stdout == nil {
+		return stdout
+	}
+
+	if i == len(p.taps)-1 {
+		// The last stage's output is only read if it is copied to the
+		// pipeline's stdout, in which case there is no need to copy
+		// it one more time:
+		if p.stdout == nil {
+			return stdout
+		}
+		t, r := newCountingTap(stdout)
+		p.taps[i] = t
+		return r
+	}
+
+	t, r, err := newStreamTap(stdout)
+	if err != nil {
+		return stdout
+	}
+	p.taps[i] = t
+	return r
+}
+
+// waitTaps waits for all of the pipeline's taps to be done.
+func (p *Pipeline) waitTaps() {
+	for _, t := range p.taps {
+		if t != nil {
+			t.wait()
+		}
+	}
+}
+
+// tap returns the tap for the output of stage `i`, or nil if it
+// doesn't have one.
+func (p *Pipeline) tap(i int) *streamTap {
+	if i < 0 || i >= len(p.taps) {
+		return nil
+	}
+	return p.taps[i]
+}
+
+// bytesOut returns the number of bytes that stage `i` has output, if
+// that was counted, or zero otherwise.
+func (p *Pipeline) bytesOut(i int) int64 {
+	if t := p.tap(i); t != nil {
+		return t.bytesCopied()
+	}
+	return 0
+}
+
+// recordWrite records that data that was read at `start` was passed to
+// the next stage at `end`.
+func (t *streamTap) recordWrite(start, end time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.firstRead.IsZero() {
+		t.firstRead = start
+	}
+	if t.firstWrite.IsZero() {
+		t.firstWrite = end
+	}
+	if end.Sub(start) >= blockedThreshold {
+		t.blocked = append(t.blocked, interval{start, end})
+	}
+}
+
+// timing returns when data first passed through the tap (see
+// `streamTap.firstRead`), and the intervals during which the previous
+// stage was blocked. It must only be called once the tap is done.
+func (t *streamTap) timing() (firstRead, firstWrite time.Time, blocked []interval) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.firstRead, t.firstWrite, t.blocked
+}
+
+// interval is a period of time.
+type interval struct {
+	start, end time.Time
+}
+
+// wait waits for the tap to be done.
+func (t *streamTap) wait() {
+	<-t.done
+}
+
+// bytesCopied returns the number of bytes that have passed through the
+// tap so far.
+func (t *streamTap) bytesCopied() int64 {
+	return atomic.LoadInt64(&t.bytes)
+}
+
+type countingReader struct {
+	t *streamTap
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	// The time between reads is spent passing the data on; if that
+	// takes long, the previous stage is probably blocked:
+	start := time.Now()
+	r.t.mu.Lock()
+	if !r.t.lastRead.IsZero() && start.Sub(r.t.lastRead) >= blockedThreshold {
+		r.t.blocked = append(r.t.blocked, interval{r.t.lastRead, start})
+	}
+	r.t.mu.Unlock()
+
+	n, err := r.t.r.Read(p)
+	atomic.AddInt64(&r.t.bytes, int64(n))
+
+	now := time.Now()
+	r.t.mu.Lock()
+	if n > 0 && r.t.firstRead.IsZero() {
+		r.t.firstRead, r.t.firstWrite = now, now
+	}
+	r.t.lastRead = now
+	r.t.mu.Unlock()
+
+	return n, err
+}
+
+func (r countingReader) Close() error {
+	defer r.t.doneOnce.Do(func() { close(r.t.done) })
+	return r.t.r.Close()
+}
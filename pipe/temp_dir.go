@@ -0,0 +1,53 @@
+package pipe
+
+import (
+	"fmt"
+	"os"
+)
+
+// WithTempDir arranges for the pipeline to create a scratch directory
+// when it is started, using `os.MkdirTemp("", pattern)`. Its path is
+// made available to stages as `Env.TempDir`, and to external commands
+// as `TMPDIR` (unless that is set explicitly by another option). The
+// directory and everything in it are removed when `Wait()` returns,
+// or if `Start()` fails.
+func WithTempDir(pattern string) Option {
+	return func(p *Pipeline) {
+		p.tempDirPattern = pattern
+		p.useTempDir = true
+	}
+}
+
+// createTempDir creates the pipeline's temporary directory, if one was
+// requested.
+func (p *Pipeline) createTempDir() error {
+	if !p.useTempDir {
+		return nil
+	}
+
+	dir, err := os.MkdirTemp("", p.tempDirPattern)
+	if err != nil {
+		return fmt.Errorf("creating temporary directory for %s: %w", p.describe(), err)
+	}
+	p.env.TempDir = dir
+	return nil
+}
+
+// removeTempDir removes the pipeline's temporary directory, if it has
+// one, emitting an event if that fails.
+func (p *Pipeline) removeTempDir() {
+	if p.env.TempDir == "" {
+		return
+	}
+
+	if err := os.RemoveAll(p.env.TempDir); err != nil {
+		p.eventHandler(&Event{
+			Command: "pipeline",
+			Msg:     "failed to remove temporary directory",
+			Err:     err,
+			Context: map[string]interface{}{
+				"dir": p.env.TempDir,
+			},
+		})
+	}
+}
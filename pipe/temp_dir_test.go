@@ -0,0 +1,103 @@
+package pipe_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/go-pipe/pipe"
+)
+
+func TestWithTempDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'sh' unavailable")
+	}
+
+	t.Parallel()
+	ctx := context.Background()
+
+	var tempDir string
+	p := pipe.New(pipe.WithTempDir("pipe-test-*"))
+	p.Add(
+		pipe.Function(
+			"write",
+			func(_ context.Context, env pipe.Env, _ io.Reader, stdout io.Writer) error {
+				tempDir = env.TempDir
+				if err := os.WriteFile(filepath.Join(env.TempDir, "data"), []byte("hello"), 0o666); err != nil {
+					return err
+				}
+				_, err := io.WriteString(stdout, env.TempDir)
+				return err
+			},
+		),
+		pipe.Command("sh", "-c", `test "$(cat)" = "$TMPDIR" && cat "$TMPDIR/data"`),
+	)
+	out, err := p.Output(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(out))
+
+	require.NotEmpty(t, tempDir)
+	assert.True(t, strings.HasPrefix(filepath.Base(tempDir), "pipe-test-"))
+	_, err = os.Stat(tempDir)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestWithTempDirRemovedOnFailure(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	t.Run("stage fails", func(t *testing.T) {
+		t.Parallel()
+
+		var tempDir string
+		p := pipe.New(pipe.WithTempDir(""))
+		p.Add(
+			pipe.Function(
+				"write",
+				func(_ context.Context, env pipe.Env, _ io.Reader, _ io.Writer) error {
+					tempDir = env.TempDir
+					if err := os.WriteFile(filepath.Join(env.TempDir, "data"), nil, 0o666); err != nil {
+						return err
+					}
+					return assert.AnError
+				},
+			),
+		)
+		assert.ErrorIs(t, p.Run(ctx), assert.AnError)
+
+		require.NotEmpty(t, tempDir)
+		_, err := os.Stat(tempDir)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("start fails", func(t *testing.T) {
+		t.Parallel()
+
+		var tempDir string
+		p := pipe.New(pipe.WithTempDir(""))
+		p.Add(
+			pipe.Function(
+				"record",
+				func(_ context.Context, env pipe.Env, _ io.Reader, _ io.Writer) error {
+					tempDir = env.TempDir
+					return nil
+				},
+			),
+			pipe.Command("this-command-does-not-exist-anywhere"),
+		)
+		assert.Error(t, p.Start(ctx))
+
+		// `Start()` waits for the stages that it started before
+		// returning the error:
+		require.NotEmpty(t, tempDir)
+		_, err := os.Stat(tempDir)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
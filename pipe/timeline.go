@@ -0,0 +1,242 @@
+package pipe
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// TimelineRecorder records the execution of pipelines, for viewing
+// in a trace viewer like Perfetto (https://ui.perfetto.dev) or
+// `chrome://tracing`. Each pipeline is shown as a process, and each
+// of its stages as a thread, with the interval during which it ran,
+// when it first received and emitted data, when it was (probably)
+// blocked writing its output because the next stage wasn't reading,
+// and when it was killed. A `TimelineRecorder` can record any number
+// of pipelines, including concurrently.
+type TimelineRecorder struct {
+	epoch time.Time
+
+	mu        sync.Mutex
+	pipelines int
+	events    []traceEvent
+}
+
+// NewTimelineRecorder returns a new, empty `TimelineRecorder`.
+func NewTimelineRecorder() *TimelineRecorder {
+	return &TimelineRecorder{epoch: time.Now()}
+}
+
+// WithTimelineRecorder records the execution of the pipeline in `r`.
+// This implies `WithIOInstrumentation()` (and its extra copy), because
+// the timeline shows when data flowed between the stages.
+func WithTimelineRecorder(r *TimelineRecorder) Option {
+	return func(p *Pipeline) {
+		p.timelineRecorder = r
+		p.instrumentIO = true
+	}
+}
+
+// traceEvent is an event in the Chrome trace-event format. See
+// https://docs.google.com/document/d/1CvAClvFfyA5R-PhYUmn5OOQtYMH4h6I0nSsKchNAySU.
+type traceEvent struct {
+	Name  string                 `json:"name"`
+	Cat   string                 `json:"cat,omitempty"`
+	Phase string                 `json:"ph"`
+	TS    int64                  `json:"ts"`
+	Dur   *int64                 `json:"dur,omitempty"`
+	PID   int                    `json:"pid"`
+	TID   int                    `json:"tid"`
+	Scope string                 `json:"s,omitempty"`
+	Args  map[string]interface{} `json:"args,omitempty"`
+}
+
+// WriteTo writes the recorded timeline to `w` as Chrome trace-event
+// JSON.
+func (r *TimelineRecorder) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	events := append([]traceEvent{}, r.events...)
+	r.mu.Unlock()
+
+	data, err := json.Marshal(struct {
+		TraceEvents     []traceEvent `json:"traceEvents"`
+		DisplayTimeUnit string       `json:"displayTimeUnit"`
+	}{
+		TraceEvents:     events,
+		DisplayTimeUnit: "ms",
+	})
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(append(data, '\n'))
+	return int64(n), err
+}
+
+// timelineRun collects the timeline of one pipeline while it runs.
+type timelineRun struct {
+	r     *TimelineRecorder
+	pid   int
+	start time.Time
+
+	mu     sync.Mutex
+	stages []timelineStage
+	kills  []traceEvent
+}
+
+// timelineStage is the timeline of one stage.
+type timelineStage struct {
+	name       string
+	start, end time.Time
+	err        error
+}
+
+// startTimeline starts recording the pipeline's timeline, if it has a
+// `TimelineRecorder`.
+func (p *Pipeline) startTimeline() {
+	r := p.timelineRecorder
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	r.pipelines++
+	pid := r.pipelines
+	r.mu.Unlock()
+
+	run := &timelineRun{
+		r:      r,
+		pid:    pid,
+		start:  p.startTime,
+		stages: make([]timelineStage, len(p.stages)),
+	}
+	for i, s := range p.stages {
+		run.stages[i].name = s.Name()
+	}
+	p.observers = append(p.observers, run.observe)
+	p.finishers = append(p.finishers, func(err error) { run.finish(p, err) })
+}
+
+// ts converts `t` into a trace-event timestamp, in microseconds since
+// the recorder was created.
+func (r *TimelineRecorder) ts(t time.Time) int64 {
+	return t.Sub(r.epoch).Microseconds()
+}
+
+// complete returns a trace event for an interval from `start` to
+// `end`.
+func (r *TimelineRecorder) complete(
+	name, cat string, pid, tid int, start, end time.Time, args map[string]interface{},
+) traceEvent {
+	dur := end.Sub(start).Microseconds()
+	return traceEvent{
+		Name: name, Cat: cat, Phase: "X", TS: r.ts(start), Dur: &dur,
+		PID: pid, TID: tid, Args: args,
+	}
+}
+
+// instant returns a trace event for something that happened at `t`.
+func (r *TimelineRecorder) instant(
+	name, cat string, pid, tid int, t time.Time, args map[string]interface{},
+) traceEvent {
+	return traceEvent{
+		Name: name, Cat: cat, Phase: "i", TS: r.ts(t), PID: pid, TID: tid,
+		Scope: "t", Args: args,
+	}
+}
+
+// metadata returns a trace event that names a process or thread.
+func metadata(name string, pid, tid int, value string) traceEvent {
+	return traceEvent{
+		Name: name, Phase: "M", PID: pid, TID: tid,
+		Args: map[string]interface{}{"name": value},
+	}
+}
+
+// observe records the stages' lifecycle events.
+func (run *timelineRun) observe(e *Event) {
+	i, ok := e.Context["stage_index"].(int)
+	if !ok || i >= len(run.stages) {
+		return
+	}
+
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	switch e.Kind {
+	case StageStarted:
+		run.stages[i].start = e.Time
+	case StageExited:
+		run.stages[i].end = e.Time
+		run.stages[i].err = e.Err
+	case StageKilled:
+		args := map[string]interface{}{
+			"signal":          e.Context["signal"],
+			"escalation_step": e.Context["escalation_step"],
+		}
+		if e.Err != nil {
+			args["reason"] = e.Err.Error()
+		}
+		run.kills = append(run.kills, run.r.instant("killed", "stage", run.pid, i+1, e.Time, args))
+	}
+}
+
+// finish adds the pipeline's timeline to the recorder. `err` is the
+// error that the pipeline failed with, if any.
+func (run *timelineRun) finish(p *Pipeline, err error) {
+	r := run.r
+	now := time.Now()
+
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	args := map[string]interface{}{"pipeline_id": p.env.PipelineID}
+	if err != nil {
+		args["error"] = err.Error()
+	}
+	events := []traceEvent{
+		metadata("process_name", run.pid, 0, fmt.Sprintf("pipeline %s", p.env.PipelineID)),
+		metadata("thread_name", run.pid, 0, "pipeline"),
+		r.complete("pipeline", "pipeline", run.pid, 0, run.start, now, args),
+	}
+
+	for i, st := range run.stages {
+		tid := i + 1
+		events = append(events, metadata("thread_name", run.pid, tid, st.name))
+		if st.start.IsZero() {
+			// The stage wasn't started.
+			continue
+		}
+
+		end := st.end
+		if end.IsZero() {
+			end = now
+		}
+		var args map[string]interface{}
+		if st.err != nil {
+			args = map[string]interface{}{"error": st.err.Error()}
+		}
+		events = append(events, r.complete(st.name, "stage", run.pid, tid, st.start, end, args))
+
+		if t := p.tap(i - 1); t != nil {
+			_, firstIn, _ := t.timing()
+			if !firstIn.IsZero() {
+				events = append(events, r.instant("first byte in", "io", run.pid, tid, firstIn, nil))
+			}
+		}
+		if t := p.tap(i); t != nil {
+			firstOut, _, blocked := t.timing()
+			if !firstOut.IsZero() {
+				events = append(events, r.instant("first byte out", "io", run.pid, tid, firstOut, nil))
+			}
+			for _, b := range blocked {
+				events = append(events, r.complete("blocked on write", "io", run.pid, tid, b.start, b.end, nil))
+			}
+		}
+	}
+	events = append(events, run.kills...)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, events...)
+}
@@ -0,0 +1,118 @@
+package pipe_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/go-pipe/pipe"
+)
+
+type traceEvent struct {
+	Name  string                 `json:"name"`
+	Cat   string                 `json:"cat"`
+	Phase string                 `json:"ph"`
+	TS    int64                  `json:"ts"`
+	Dur   int64                  `json:"dur"`
+	PID   int                    `json:"pid"`
+	TID   int                    `json:"tid"`
+	Args  map[string]interface{} `json:"args"`
+}
+
+func findTraceEvents(events []traceEvent, pid, tid int, name string) []traceEvent {
+	var found []traceEvent
+	for _, e := range events {
+		if e.PID == pid && e.TID == tid && e.Name == name {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+func TestTimelineRecorder(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'seq' unavailable")
+	}
+
+	t.Parallel()
+
+	rec := pipe.NewTimelineRecorder()
+
+	// `seq` produces more output than fits in a pipe buffer, and the
+	// next stage only starts reading after a while, so `seq` gets
+	// blocked:
+	p := pipe.New(pipe.WithID("first"), pipe.WithTimelineRecorder(rec))
+	p.Add(
+		pipe.Command("seq", "200000"),
+		pipe.Function(
+			"slow",
+			func(_ context.Context, _ pipe.Env, stdin io.Reader, _ io.Writer) error {
+				time.Sleep(50 * time.Millisecond)
+				_, err := io.Copy(io.Discard, stdin)
+				return err
+			},
+		),
+	)
+	require.NoError(t, p.Run(context.Background()))
+
+	// A second pipeline, which gets killed:
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p = pipe.New(pipe.WithID("second"), pipe.WithTimelineRecorder(rec))
+	p.Add(pipe.Command("sleep", "10"))
+	require.NoError(t, p.Start(ctx))
+	cancel()
+	require.Error(t, p.Wait())
+
+	var buf bytes.Buffer
+	_, err := rec.WriteTo(&buf)
+	require.NoError(t, err)
+
+	var trace struct {
+		TraceEvents []traceEvent `json:"traceEvents"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &trace))
+	events := trace.TraceEvents
+
+	names := findTraceEvents(events, 1, 0, "process_name")
+	require.Len(t, names, 1)
+	assert.Equal(t, "pipeline first", names[0].Args["name"])
+
+	pipelineEvents := findTraceEvents(events, 1, 0, "pipeline")
+	require.Len(t, pipelineEvents, 1)
+	assert.Equal(t, "X", pipelineEvents[0].Phase)
+
+	seq := findTraceEvents(events, 1, 1, "seq")
+	require.Len(t, seq, 1)
+	assert.Equal(t, "X", seq[0].Phase)
+	assert.GreaterOrEqual(t, seq[0].TS, pipelineEvents[0].TS)
+
+	assert.Len(t, findTraceEvents(events, 1, 1, "first byte out"), 1)
+	assert.NotEmpty(t, findTraceEvents(events, 1, 1, "blocked on write"))
+
+	slow := findTraceEvents(events, 1, 2, "slow")
+	require.Len(t, slow, 1)
+	assert.GreaterOrEqual(t, slow[0].Dur, int64(50*time.Millisecond/time.Microsecond))
+	firstIn := findTraceEvents(events, 1, 2, "first byte in")
+	require.Len(t, firstIn, 1)
+	assert.GreaterOrEqual(t, firstIn[0].TS, slow[0].TS)
+
+	names = findTraceEvents(events, 2, 0, "process_name")
+	require.Len(t, names, 1)
+	assert.Equal(t, "pipeline second", names[0].Args["name"])
+
+	killed := findTraceEvents(events, 2, 1, "killed")
+	require.Len(t, killed, 1)
+	assert.Equal(t, "terminated", killed[0].Args["signal"])
+	assert.Equal(t, "context canceled", killed[0].Args["reason"])
+	sleep := findTraceEvents(events, 2, 1, "sleep")
+	require.Len(t, sleep, 1)
+	assert.Contains(t, sleep[0].Args["error"], "context canceled")
+}
@@ -0,0 +1,183 @@
+package pipe
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Tracer creates the spans that describe the execution of a pipeline:
+// one for the pipeline, and a child span for each of its stages. It
+// can be implemented using any tracing library, without the pipeline
+// having to depend on it; the `otelpipe` module
+// (github.com/github/go-pipe/pipe/otelpipe) implements it using
+// OpenTelemetry.
+type Tracer interface {
+	// StartSpan starts a span called `name`, as a child of the span
+	// in `ctx` (if any). It returns a context containing the new
+	// span, and the span itself.
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+
+	// EnvVars returns the environment variables that propagate the
+	// trace context in `ctx` to a child process, like `TRACEPARENT`.
+	EnvVars(ctx context.Context) []EnvVar
+}
+
+// Span is a span that was started by a `Tracer`. Its methods may be
+// called from different goroutines, but not concurrently.
+type Span interface {
+	// SetAttribute sets an attribute of the span. `value` is a
+	// string, an int, an int64, a `[]string`, or a `time.Duration`.
+	SetAttribute(key string, value interface{})
+
+	// RecordError records that the span's operation failed with
+	// `err`.
+	RecordError(err error)
+
+	// End ends the span, which ended at `end`.
+	End(end time.Time)
+}
+
+// WithTracer arranges for `tracer` to trace the pipeline. Its span is
+// a child of the span in the context passed to `Start()`, and has
+// "pipeline_id" and "stages" attributes. The span of each stage is
+// passed to the stage in the context given to its `Start()` method,
+// and exported to external commands via `tracer.EnvVars()`. It has
+// the attribute "stage_index" and, for commands, "argv", "dir", "pid",
+// "exit_code", and "signal" (if the command was killed by a signal).
+// If the pipeline is also created `WithIOInstrumentation()`, stage
+// spans have "bytes_in" and "bytes_out" attributes, too.
+func WithTracer(tracer Tracer) Option {
+	return func(p *Pipeline) {
+		p.tracer = tracer
+		p.env.addVars("WithTracer", func(ctx context.Context, vars []EnvVar) []EnvVar {
+			return append(vars, tracer.EnvVars(ctx)...)
+		})
+	}
+}
+
+// pipelineTrace holds the spans of a traced pipeline.
+type pipelineTrace struct {
+	span Span
+
+	mu     sync.Mutex
+	stages []*stageTrace
+}
+
+// stageTrace holds the span of a stage, and when it ended.
+type stageTrace struct {
+	span Span
+	end  time.Time
+}
+
+// startTrace starts the pipeline's span, if it is traced, and returns
+// the context that should be used for its stages.
+func (p *Pipeline) startTrace(ctx context.Context) context.Context {
+	if p.tracer == nil {
+		return ctx
+	}
+
+	ctx, span := p.tracer.StartSpan(ctx, "pipeline")
+	span.SetAttribute("pipeline_id", p.env.PipelineID)
+	p.trace = &pipelineTrace{span: span}
+	p.observers = append(p.observers, p.trace.observe)
+	p.finishers = append(p.finishers, p.finishTrace)
+	return ctx
+}
+
+// startStageTrace starts the span for stage `i`, if the pipeline is
+// traced, and returns the context that should be passed to the stage.
+func (p *Pipeline) startStageTrace(ctx context.Context, i int, s Stage) context.Context {
+	if p.trace == nil {
+		return ctx
+	}
+
+	ctx, span := p.tracer.StartSpan(ctx, s.Name())
+	span.SetAttribute("stage_index", i)
+
+	p.trace.mu.Lock()
+	defer p.trace.mu.Unlock()
+	p.trace.stages = append(p.trace.stages, &stageTrace{span: span})
+	return ctx
+}
+
+// observe records the details of lifecycle events in the spans of the
+// corresponding stages.
+func (t *pipelineTrace) observe(e *Event) {
+	if e.Kind != StageStarted && e.Kind != StageExited {
+		return
+	}
+	i, ok := e.Context["stage_index"].(int)
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if i >= len(t.stages) {
+		return
+	}
+	st := t.stages[i]
+
+	switch e.Kind {
+	case StageStarted:
+		for _, key := range []string{"argv", "dir", "pid"} {
+			if v, ok := e.Context[key]; ok {
+				st.span.SetAttribute(key, v)
+			}
+		}
+	case StageExited:
+		for _, key := range []string{"exit_code", "signal"} {
+			if v, ok := e.Context[key]; ok {
+				st.span.SetAttribute(key, v)
+			}
+		}
+		if e.Err != nil && !errors.Is(e.Err, FinishEarly) {
+			st.span.RecordError(e.Err)
+		}
+		st.end = e.Time
+	}
+}
+
+// recordStartError records that stage `i` failed to start with `err`,
+// if the pipeline is traced.
+func (p *Pipeline) recordStartError(i int, err error) {
+	if p.trace == nil {
+		return
+	}
+
+	p.trace.mu.Lock()
+	defer p.trace.mu.Unlock()
+	if i < len(p.trace.stages) {
+		p.trace.stages[i].span.RecordError(err)
+	}
+}
+
+// finishTrace ends the pipeline's spans. `err` is the error that the
+// pipeline failed with, if any.
+func (p *Pipeline) finishTrace(err error) {
+	now := time.Now()
+
+	p.trace.mu.Lock()
+	defer p.trace.mu.Unlock()
+	for i, st := range p.trace.stages {
+		if p.instrumentIO {
+			if i > 0 {
+				st.span.SetAttribute("bytes_in", p.bytesOut(i-1))
+			}
+			st.span.SetAttribute("bytes_out", p.bytesOut(i))
+		}
+		end := st.end
+		if end.IsZero() {
+			end = now
+		}
+		st.span.End(end)
+	}
+
+	p.trace.span.SetAttribute("stages", len(p.trace.stages))
+	if err != nil {
+		p.trace.span.RecordError(err)
+	}
+	p.trace.span.End(now)
+}
@@ -0,0 +1,209 @@
+package pipe_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/go-pipe/pipe"
+)
+
+type spanKey struct{}
+
+// fakeTracer is a `pipe.Tracer` that records the spans that it starts.
+type fakeTracer struct {
+	mu    sync.Mutex
+	spans []*fakeSpan
+}
+
+type fakeSpan struct {
+	id     int
+	name   string
+	parent *fakeSpan
+
+	mu     sync.Mutex
+	attrs  map[string]interface{}
+	errs   []error
+	ended  bool
+	endsAt time.Time
+}
+
+func (t *fakeTracer) StartSpan(ctx context.Context, name string) (context.Context, pipe.Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	parent, _ := ctx.Value(spanKey{}).(*fakeSpan)
+	s := &fakeSpan{
+		id:     len(t.spans) + 1,
+		name:   name,
+		parent: parent,
+		attrs:  make(map[string]interface{}),
+	}
+	t.spans = append(t.spans, s)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (t *fakeTracer) EnvVars(ctx context.Context) []pipe.EnvVar {
+	s, ok := ctx.Value(spanKey{}).(*fakeSpan)
+	if !ok {
+		return nil
+	}
+	return []pipe.EnvVar{{Key: "TRACEPARENT", Value: fmt.Sprintf("00-trace-%d-01", s.id)}}
+}
+
+func (t *fakeTracer) span(name string) *fakeSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.spans {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func (s *fakeSpan) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs[key] = value
+}
+
+func (s *fakeSpan) RecordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errs = append(s.errs, err)
+}
+
+func (s *fakeSpan) End(end time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ended = true
+	s.endsAt = end
+}
+
+func TestWithTracer(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'sh' unavailable")
+	}
+
+	t.Parallel()
+	ctx := context.Background()
+
+	var tracer fakeTracer
+	p := pipe.New(pipe.WithID("traced"), pipe.WithTracer(&tracer), pipe.WithIOInstrumentation())
+	p.Add(
+		pipe.Command("sh", "-c", `echo "$TRACEPARENT"; printf 'abcdef'`),
+		pipe.Function(
+			"upcase",
+			func(_ context.Context, _ pipe.Env, stdin io.Reader, stdout io.Writer) error {
+				in, err := io.ReadAll(stdin)
+				if err != nil {
+					return err
+				}
+				_, err = io.WriteString(stdout, strings.ToUpper(string(in)))
+				return err
+			},
+		),
+		pipe.Command("sh", "-c", `cat; exit 5`),
+	)
+	out, err := p.Output(ctx)
+	require.Error(t, err)
+	assert.Equal(t, "00-TRACE-2-01\nABCDEF", string(out))
+
+	require.Len(t, tracer.spans, 4)
+	ps := tracer.span("pipeline")
+	require.NotNil(t, ps)
+	assert.True(t, ps.ended)
+	assert.Equal(t, "traced", ps.attrs["pipeline_id"])
+	assert.Equal(t, 3, ps.attrs["stages"])
+	require.Len(t, ps.errs, 1)
+	assert.Equal(t, err, ps.errs[0])
+
+	for i, s := range tracer.spans[1:] {
+		assert.Same(t, ps, s.parent)
+		assert.True(t, s.ended)
+		assert.Equal(t, i, s.attrs["stage_index"])
+	}
+
+	first := tracer.spans[1]
+	assert.Equal(t, "sh", first.name)
+	assert.Positive(t, first.attrs["pid"])
+	assert.Equal(t, []string{"sh", "-c", `echo "$TRACEPARENT"; printf 'abcdef'`}, first.attrs["argv"])
+	assert.Equal(t, 0, first.attrs["exit_code"])
+	assert.NotContains(t, first.attrs, "bytes_in")
+	assert.EqualValues(t, 20, first.attrs["bytes_out"])
+	assert.Empty(t, first.errs)
+
+	upcase := tracer.span("upcase")
+	assert.EqualValues(t, 20, upcase.attrs["bytes_in"])
+	assert.EqualValues(t, 20, upcase.attrs["bytes_out"])
+	assert.Empty(t, upcase.errs)
+
+	last := tracer.spans[3]
+	assert.Equal(t, 5, last.attrs["exit_code"])
+	assert.EqualValues(t, 20, last.attrs["bytes_in"])
+	assert.EqualValues(t, 20, last.attrs["bytes_out"])
+	assert.Len(t, last.errs, 1)
+}
+
+func TestWithTracerEPIPE(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FIXME: test skipped on Windows: 'seq' unavailable")
+	}
+
+	t.Parallel()
+	ctx := context.Background()
+
+	// Instrumenting the data flow mustn't change how a stage that
+	// stops reading early affects the previous one (see
+	// `TestBigEPIPE`):
+	var tracer fakeTracer
+	p := pipe.New(pipe.WithTracer(&tracer), pipe.WithIOInstrumentation())
+	p.Add(
+		pipe.Command("seq", "100000"),
+		pipe.Command("true"),
+	)
+	assert.EqualError(t, p.Run(ctx), "seq: signal: broken pipe")
+
+	seq := tracer.span("seq")
+	require.NotNil(t, seq)
+	assert.Equal(t, "broken pipe", seq.attrs["signal"])
+}
+
+func TestWithTracerStartFailure(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	var tracer fakeTracer
+	p := pipe.New(pipe.WithTracer(&tracer))
+	p.Add(
+		pipe.Function(
+			"ok",
+			func(_ context.Context, _ pipe.Env, _ io.Reader, stdout io.Writer) error {
+				_, err := io.WriteString(stdout, "data")
+				return err
+			},
+		),
+		pipe.Command("this-command-does-not-exist-anywhere"),
+	)
+	err := p.Start(ctx)
+	require.Error(t, err)
+
+	require.Len(t, tracer.spans, 3)
+	for _, s := range tracer.spans {
+		assert.True(t, s.ended, s.name)
+	}
+	assert.Len(t, tracer.spans[0].errs, 1)
+	assert.Len(t, tracer.spans[2].errs, 1)
+
+	// Without `WithIOInstrumentation()`, bytes aren't counted:
+	assert.NotContains(t, tracer.spans[1].attrs, "bytes_out")
+}